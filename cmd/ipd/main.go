@@ -1,26 +1,124 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
 	"log"
 
 	flags "github.com/jessevdk/go-flags"
 
+	"crypto/tls"
+	"net"
 	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/mpolden/ipd/http"
 	"github.com/mpolden/ipd/iputil"
+	"github.com/mpolden/ipd/iputil/bogon"
+	"github.com/mpolden/ipd/iputil/cdn"
 	"github.com/mpolden/ipd/iputil/database"
+	"github.com/mpolden/ipd/iputil/tor"
+	"github.com/mpolden/ipd/ja3"
+	"github.com/mpolden/ipd/proxyproto"
 )
 
 func main() {
 	var opts struct {
-		CountryDBPath string `short:"f" long:"country-db" description:"Path to GeoIP country database" value-name:"FILE" default:""`
-		CityDBPath    string `short:"c" long:"city-db" description:"Path to GeoIP city database" value-name:"FILE" default:""`
-		Listen        string `short:"l" long:"listen" description:"Listening address" value-name:"ADDR" default:":8080"`
-		ReverseLookup bool   `short:"r" long:"reverse-lookup" description:"Perform reverse hostname lookups"`
-		PortLookup    bool   `short:"p" long:"port-lookup" description:"Enable port lookup"`
-		Template      string `short:"t" long:"template" description:"Path to template" default:"index.html" value-name:"FILE"`
-		IPHeader      string `short:"H" long:"trusted-header" description:"Header to trust for remote IP, if present (e.g. X-Real-IP)" value-name:"NAME"`
+		CountryDBPath   string            `short:"f" long:"country-db" description:"Path to GeoIP country database" value-name:"FILE" default:""`
+		CityDBPath      string            `short:"c" long:"city-db" description:"Path to GeoIP city database" value-name:"FILE" default:""`
+		ISPDBPath       string            `short:"i" long:"isp-db" description:"Path to GeoIP ISP database" value-name:"FILE" default:""`
+		AnonymousDB     string            `long:"anonymous-db" description:"Path to GeoIP2 Anonymous IP database, used to warn when the IP belongs to a hosting provider" value-name:"FILE"`
+		EnterpriseDB    string            `long:"enterprise-db" description:"Path to GeoIP2 Enterprise database, replacing country, city and ISP databases" value-name:"FILE"`
+		CSVDB           string            `long:"csv-db" description:"Path to CSV database with rows of start_ip,end_ip,country,city, replacing country and city databases" value-name:"FILE"`
+		DegradeOnDBErr  bool              `long:"degrade-on-db-error" description:"Start without geo lookups if a database cannot be opened"`
+		CacheSize       int               `long:"cache-size" description:"Number of geo lookup results to cache (0 for no cache)" value-name:"N" default:"0"`
+		CachePrefix4    int               `long:"cache-prefix4" description:"Prefix length of IPv4 networks sharing a cached result, shorter is faster but less accurate" value-name:"N" default:"32"`
+		CachePrefix6    int               `long:"cache-prefix6" description:"Prefix length of IPv6 networks sharing a cached result, shorter is faster but less accurate" value-name:"N" default:"128"`
+		Listen          string            `short:"l" long:"listen" description:"Listening address" value-name:"ADDR" default:":8080"`
+		TLSCert         string            `long:"tls-cert" description:"Path to TLS certificate, enables HTTPS" value-name:"FILE"`
+		TLSKey          string            `long:"tls-key" description:"Path to TLS private key" value-name:"FILE"`
+		HTTP3Listen     string            `long:"http3-listen" description:"Listening address for HTTP/3, advertised to HTTPS clients (requires TLS)" value-name:"ADDR"`
+		ServerName      bool              `long:"server-name" description:"Include server name sent by client using TLS SNI in responses"`
+		ProxyProtocol   bool              `long:"proxy-protocol" description:"Read client address from PROXY protocol header sent by trusted proxies"`
+		TrustedProxies  []string          `long:"trusted-proxy" description:"Network or IP of trusted proxy, client headers from other peers are ignored (can be repeated)" value-name:"CIDR"`
+		AdminListen     string            `long:"admin-listen" description:"Listening address for admin endpoints (/health and /debug/routes)" value-name:"ADDR"`
+		ReverseLookup   bool              `short:"r" long:"reverse-lookup" description:"Perform reverse hostname lookups"`
+		DoHURL          string            `long:"doh-url" description:"Use DNS over HTTPS server at URL for DNS lookups" value-name:"URL"`
+		VerifyHostname  bool              `long:"verify-hostname" description:"Check that reverse lookup results resolve back to the IP"`
+		StripSuffixes   []string          `long:"strip-hostname-suffix" description:"Domain to strip from hostnames in responses (can be repeated)" value-name:"DOMAIN"`
+		Resolve         bool              `long:"resolve" description:"Enable /resolve endpoint for looking up addresses of hostnames"`
+		ResolveLimit    int               `long:"resolve-rate-limit" description:"Maximum number of /resolve requests per minute per client" value-name:"N" default:"10"`
+		LookupRetries   int               `long:"lookup-retries" description:"Number of times to retry reverse lookups failing temporarily" value-name:"N" default:"2"`
+		RawLookup       bool              `long:"raw-lookup" description:"Enable /raw endpoint exposing full database records"`
+		Batch           bool              `long:"batch" description:"Enable batch lookup of CSV files at /batch.csv"`
+		ServerHost      string            `long:"server-hostname" description:"Enable /server endpoint showing given hostname of this server and its addresses" value-name:"NAME"`
+		PoP             string            `long:"pop" description:"Point of presence of this server, shown in /server" value-name:"NAME" env:"IPD_POP"`
+		Region          string            `long:"region" description:"Region of this server, shown in /server" value-name:"NAME" env:"IPD_REGION"`
+		Network         bool              `long:"network" description:"Include the network of the IP from the ISP database, or its /24 or /48, in responses"`
+		Speed           bool              `long:"speed" description:"Enable speed test endpoints /speed and /speed/upload"`
+		OpenAPI         bool              `long:"openapi" description:"Serve OpenAPI document describing enabled endpoints at /openapi.json"`
+		PortLookup      bool              `short:"p" long:"port-lookup" description:"Enable port lookup"`
+		Template        string            `short:"t" long:"template" description:"Path to template" default:"index.html" value-name:"FILE"`
+		HostTemplates   map[string]string `long:"host-template" description:"Path to template for given host (can be repeated)" value-name:"HOST:FILE"`
+		GeoOverrides    []string          `long:"geo-override" description:"Use static geo information for network, on the form CIDR=ISO,COUNTRY,CITY (can be repeated)" value-name:"SPEC"`
+		UnknownCountry  string            `long:"unknown-country" description:"Country name to display in template for IPs without a known country" value-name:"NAME"`
+		HostLanguages   map[string]string `long:"host-language" description:"Default language of country and city names for given host, overridden by Accept-Language (can be repeated)" value-name:"HOST:LANG"`
+		ErrorTemplate   string            `long:"error-template" description:"Path to template for errors shown to browsers" value-name:"FILE"`
+		CLITemplate     string            `long:"cli-template" description:"Path to text template for / when requested by command-line clients, instead of only the IP" value-name:"FILE"`
+		SigningKeyFile  string            `long:"signing-key-file" description:"Sign JSON responses with HMAC-SHA256 using key read from FILE" value-name:"FILE"`
+		APIKeyFile      string            `long:"api-key-file" description:"Require one of the API keys in FILE (one per line) for /raw, /batch.csv and /resolve" value-name:"FILE"`
+		APIKeyHeader    string            `long:"api-key-header" description:"Header containing API key" value-name:"NAME" default:"X-API-Key"`
+		JA3             bool              `long:"ja3" description:"Include JA3 fingerprint of TLS clients in JSON responses"`
+		FixedResponse   string            `long:"fixed-response" description:"Respond with the JSON response in FILE regardless of client, for testing clients" value-name:"FILE"`
+		DevMode         bool              `long:"dev" description:"Development mode (re-read template on every request)"`
+		IPHeader        string            `short:"H" long:"trusted-header" description:"Header to trust for remote IP, if present (e.g. X-Real-IP or Forwarded)" value-name:"NAME"`
+		TrustedHops     int               `long:"trusted-hops" description:"Number of trusted proxies in X-Forwarded-For or Forwarded header, the client IP is the hop left of them" value-name:"N"`
+		ForwardedURL    bool              `long:"forwarded-url" description:"Trust X-Forwarded-Proto and X-Forwarded-Host headers for the scheme and host of absolute URLs"`
+		MaxPathLength   int               `long:"max-path-length" description:"Maximum length of URL path (0 for no limit)" value-name:"N" default:"1024"`
+		MaxLookups      int               `short:"m" long:"max-lookups" description:"Maximum number of concurrent lookups (0 for no limit)" value-name:"N" default:"256"`
+		EventInterval   time.Duration     `long:"event-interval" description:"Enable /events endpoint sending the IP as server-sent events at given interval" value-name:"DURATION"`
+		MaxStreams      int               `long:"max-streams" description:"Maximum number of concurrent /events streams (0 for no limit)" value-name:"N" default:"64"`
+		MaxDials        int               `long:"max-dials" description:"Maximum number of concurrent outbound dials for port tests (0 for no limit)" value-name:"N" default:"64"`
+		MaxClientDials  int               `long:"max-client-dials" description:"Maximum number of concurrent outbound dials for port tests per client (0 for no limit)" value-name:"N" default:"8"`
+		RequestTimeout  time.Duration     `long:"request-timeout" description:"Maximum time to spend handling a request, streamed responses such as /events end at this deadline (0 for no limit)" value-name:"DURATION" default:"0"`
+		NullFields      bool              `long:"null-fields" description:"Include unknown fields as null in JSON responses instead of omitting them"`
+		CamelCase       bool              `long:"camel-case" description:"Use camelCase keys in JSON responses"`
+		NoContent       bool              `long:"no-content" description:"Respond with 204 No Content when a country or city is unknown in text responses"`
+		TextContentType string            `long:"text-content-type" description:"Content-Type of text responses (charset=utf-8 is added if missing)" value-name:"TYPE" default:"text/plain"`
+		CountryFlag     bool              `long:"country-flag" description:"Include country flag emoji in JSON responses"`
+		ReverseName     bool              `long:"reverse-name" description:"Include PTR query name of IP in JSON responses"`
+		Timestamp       bool              `long:"timestamp" description:"Include server time of request in JSON responses"`
+		SourcePort      bool              `long:"source-port" description:"Include client source port in responses"`
+		PortHeader      string            `long:"trusted-port-header" description:"Non-standard header to trust for client source port, if present (not X-Forwarded-Port, which is the destination port)" value-name:"NAME"`
+		RateLimit       int               `long:"rate-limit" description:"Maximum number of requests per minute per client (0 for no limit)" value-name:"N" default:"0"`
+		RateLimitBurst  int               `long:"rate-limit-burst" description:"Number of requests a client can make in a burst" value-name:"N" default:"10"`
+		RateLimitExempt []string          `long:"rate-limit-exempt" description:"Network or IP exempt from rate limiting (can be repeated)" value-name:"CIDR"`
+		DecimalString   bool              `long:"decimal-string" description:"Encode ip_decimal as a string in JSON responses"`
+		PortString      bool              `long:"port-string" description:"Encode port as a string in JSON responses"`
+		SecurityHeaders bool              `long:"security-headers" description:"Send HSTS, nosniff and Content-Security-Policy headers"`
+		Gzip            bool              `long:"gzip" description:"Compress responses using gzip"`
+		MinCompressSize int               `long:"gzip-min-size" description:"Minimum response size in bytes to compress" value-name:"N" default:"1024"`
+		AccessLog       string            `short:"a" long:"access-log" description:"Write access log to stdout in given format" value-name:"FORMAT" choice:"json" choice:"clf" choice:"combined"`
+		AnonymizeLog    bool              `long:"anonymize-log" description:"Mask the last octet of IPv4 and last 80 bits of IPv6 addresses in the access log"`
+		RequireUA       bool              `long:"require-user-agent" description:"Reject requests without a User-Agent header"`
+		IPLookup        bool              `long:"ip-lookup" description:"Enable lookup of any IP address using /IP/all"`
+		IPRespHeader    bool              `long:"ip-response-header" description:"Include IP of client in X-Your-IP header of all responses"`
+		RedirectHTTPS   bool              `long:"redirect-https" description:"Redirect browsers making HTTP requests to HTTPS, answering command-line clients over HTTP"`
+		AllowedHosts    []string          `long:"allow-host" description:"Only serve requests for given host (can be repeated)" value-name:"HOST"`
+		AllFields       []string          `long:"all-field" description:"Field to include in /all, in order (can be repeated, default: all fields)" value-name:"NAME"`
+		RootOrder       []string          `long:"root-order" description:"Order in which to try root handlers (can be repeated)" value-name:"NAME" choice:"json" choice:"cli" choice:"text"`
+		DisabledRoutes  []string          `long:"disable-route" description:"Disable route with given path (can be repeated)" value-name:"PATH"`
+		TorExitList     string            `long:"tor-exit-list" description:"Flag Tor exit nodes using list at URL" value-name:"URL" optional:"true" optional-value:"https://check.torproject.org/torbulkexitlist"`
+		TorRefresh      time.Duration     `long:"tor-refresh" description:"Refresh interval for Tor exit list" value-name:"DURATION" default:"1h"`
+		Bogons          bool              `long:"bogons" description:"Flag IPs in bogon prefixes"`
+		BogonList       string            `long:"bogon-list" description:"Read bogon prefixes from FILE instead of using the built-in list" value-name:"FILE"`
+		CDN             string            `long:"cdn" description:"Trust client IP header sent from published IP ranges of CDN" value-name:"NAME" choice:"cloudflare" choice:"fastly" choice:"cloudfront"`
+		CDNRefresh      time.Duration     `long:"cdn-refresh" description:"Refresh interval for CDN IP ranges" value-name:"DURATION" default:"24h"`
 	}
 	_, err := flags.ParseArgs(&opts, os.Args)
 	if err != nil {
@@ -28,28 +126,352 @@ func main() {
 	}
 
 	log := log.New(os.Stderr, "ipd: ", 0)
-	db, err := database.New(opts.CountryDBPath, opts.CityDBPath)
-	if err != nil {
+	if opts.EnterpriseDB != "" && (opts.CountryDBPath != "" || opts.CityDBPath != "" || opts.ISPDBPath != "" ||
+		opts.AnonymousDB != "") {
+		log.Fatal("Enterprise database cannot be combined with country, city, ISP or anonymous IP databases")
+	}
+	if opts.CSVDB != "" && (opts.EnterpriseDB != "" || opts.CountryDBPath != "" || opts.CityDBPath != "" ||
+		opts.ISPDBPath != "" || opts.AnonymousDB != "") {
+		log.Fatal("CSV database cannot be combined with other databases")
+	}
+	open := func() (database.Client, error) {
+		if opts.EnterpriseDB != "" {
+			return database.NewEnterprise(opts.EnterpriseDB)
+		}
+		if opts.CSVDB != "" {
+			return database.NewCSV(opts.CSVDB)
+		}
+		return database.New(opts.CountryDBPath, opts.CityDBPath, opts.ISPDBPath, opts.AnonymousDB)
+	}
+	server := http.New(nil)
+	server.DegradeOnDBError = opts.DegradeOnDBErr
+	var reloadable *database.Reloadable
+	err = server.OpenDatabase(func() (database.Client, error) {
+		var err error
+		reloadable, err = database.NewReloadable(func() (database.Client, error) {
+			client, err := open()
+			if err != nil || opts.CacheSize == 0 {
+				return client, err
+			}
+			// Each reload gets a new cache, as cached results from the previous database may be outdated
+			return database.NewCache(client, opts.CacheSize, opts.CachePrefix4, opts.CachePrefix6)
+		})
+		return reloadable, err
+	})
+	if err == nil {
+		go func() {
+			sig := make(chan os.Signal, 1)
+			signal.Notify(sig, syscall.SIGHUP)
+			for range sig {
+				if err := reloadable.Reload(); err != nil {
+					log.Printf("Failed to reload database: %s", err)
+				} else {
+					log.Println("Reloaded database")
+				}
+			}
+		}()
+	} else if opts.DegradeOnDBErr {
+		log.Printf("Failed to open database, disabling geo lookups: %s", err)
+	} else {
 		log.Fatal(err)
 	}
 
-	server := http.New(db)
 	server.Template = opts.Template
+	server.HostTemplates = opts.HostTemplates
+	server.HostLanguages = opts.HostLanguages
+	server.ErrorTemplate = opts.ErrorTemplate
+	server.CLITemplate = opts.CLITemplate
+	if err := server.CheckTemplates(); err != nil {
+		log.Printf("Invalid template, HTML responses will fail: %s", err)
+	}
+	server.DevMode = opts.DevMode
+	server.UnknownCountry = opts.UnknownCountry
+	for _, spec := range opts.GeoOverrides {
+		o, err := http.ParseGeoOverride(spec)
+		if err != nil {
+			log.Fatal(err)
+		}
+		server.GeoOverrides = append(server.GeoOverrides, o)
+	}
 	server.IPHeader = opts.IPHeader
+	server.MaxLookups = opts.MaxLookups
+	server.MaxPathLength = opts.MaxPathLength
+	server.TrustedHops = opts.TrustedHops
+	server.ForwardedURL = opts.ForwardedURL
+	server.RequestTimeout = opts.RequestTimeout
+	server.EventInterval = opts.EventInterval
+	server.MaxStreams = opts.MaxStreams
+	server.MaxDials = opts.MaxDials
+	server.MaxClientDials = opts.MaxClientDials
+	server.DecimalString = opts.DecimalString
+	server.PortString = opts.PortString
+	server.CamelCase = opts.CamelCase
+	server.NullFields = opts.NullFields
+	server.CountryFlag = opts.CountryFlag
+	server.NoContent = opts.NoContent
+	server.TextContentType = opts.TextContentType
+	server.SourcePort = opts.SourcePort
+	server.Timestamp = opts.Timestamp
+	server.ReverseName = opts.ReverseName
+	server.PortHeader = opts.PortHeader
+	server.DisabledRoutes = opts.DisabledRoutes
+	server.RootOrder = opts.RootOrder
+	if err := http.ValidateFields(opts.AllFields); err != nil {
+		log.Fatal(err)
+	}
+	server.AllFields = opts.AllFields
+	server.AllowedHosts = opts.AllowedHosts
+	server.RequireUserAgent = opts.RequireUA
+	server.RedirectHTTPS = opts.RedirectHTTPS
+	server.IPResponseHeader = opts.IPRespHeader
+	server.IPLookup = opts.IPLookup
+	for _, path := range opts.DisabledRoutes {
+		log.Printf("Disabling route %s", path)
+	}
+	if opts.SigningKeyFile != "" {
+		key, err := ioutil.ReadFile(opts.SigningKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if key = bytes.TrimSpace(key); len(key) == 0 {
+			log.Fatalf("%s: signing key is empty", opts.SigningKeyFile)
+		}
+		log.Printf("Signing JSON responses with key from %s", opts.SigningKeyFile)
+		server.SigningKey = key
+	}
+	if opts.APIKeyFile != "" {
+		b, err := ioutil.ReadFile(opts.APIKeyFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, key := range strings.Split(string(b), "\n") {
+			if key = strings.TrimSpace(key); key != "" {
+				server.APIKeys = append(server.APIKeys, key)
+			}
+		}
+		if len(server.APIKeys) == 0 {
+			log.Fatalf("%s: no API keys found", opts.APIKeyFile)
+		}
+		log.Printf("Requiring API key in header %s for restricted endpoints", opts.APIKeyHeader)
+		server.APIKeyHeader = opts.APIKeyHeader
+	}
+	if opts.FixedResponse != "" {
+		f, err := os.Open(opts.FixedResponse)
+		if err != nil {
+			log.Fatal(err)
+		}
+		var response http.Response
+		if err := json.NewDecoder(f).Decode(&response); err != nil {
+			log.Fatalf("%s: %s", opts.FixedResponse, err)
+		}
+		f.Close()
+		log.Printf("Responding with fixed response from %s", opts.FixedResponse)
+		server.FixedResponse = &response
+	}
 	if opts.ReverseLookup {
 		log.Println("Enabling reverse lookup")
 		server.LookupAddr = iputil.LookupAddr
+		if opts.DoHURL != "" {
+			log.Printf("Using DNS over HTTPS server %s", opts.DoHURL)
+			server.LookupAddr = iputil.NewDoHResolver(opts.DoHURL).LookupAddr
+		}
+		if opts.LookupRetries > 0 {
+			server.LookupAddr = iputil.RetryLookupAddr(server.LookupAddr, opts.LookupRetries, 100*time.Millisecond)
+		}
+	}
+	if opts.Resolve || opts.VerifyHostname || opts.ServerHost != "" {
+		server.LookupHost = iputil.LookupHost
+		if opts.DoHURL != "" {
+			server.LookupHost = iputil.NewDoHResolver(opts.DoHURL).LookupHost
+		}
+	}
+	if opts.Resolve {
+		if opts.ResolveLimit <= 0 && opts.RateLimit <= 0 {
+			log.Fatal("--resolve requires --resolve-rate-limit or --rate-limit")
+		}
+		log.Println("Enabling hostname resolving")
+		server.Resolve = true
+		server.ResolveRateLimit = opts.ResolveLimit
+	}
+	if opts.VerifyHostname {
+		if !opts.ReverseLookup {
+			log.Fatal("Verifying hostnames requires reverse lookup")
+		}
+		log.Println("Verifying that hostnames resolve to the IP they were looked up for")
+		server.VerifyHostname = true
+	}
+	server.StripSuffixes = opts.StripSuffixes
+	if opts.RawLookup {
+		log.Println("Enabling raw database lookup")
+		server.RawLookup = true
+	}
+	if opts.Batch {
+		log.Println("Enabling batch lookup")
+		server.Batch = true
+	}
+	server.Network = opts.Network
+	server.ServerHostname = opts.ServerHost
+	server.PoP = opts.PoP
+	server.Region = opts.Region
+	if opts.Speed {
+		log.Println("Enabling speed test")
+		server.Speed = true
+	}
+	if opts.OpenAPI {
+		log.Println("Serving OpenAPI document")
+		server.OpenAPI = true
 	}
 	if opts.PortLookup {
 		log.Println("Enabling port lookup")
 		server.LookupPort = iputil.LookupPort
 	}
+	if opts.TorExitList != "" {
+		log.Printf("Flagging Tor exit nodes using %s", opts.TorExitList)
+		exits := tor.New(opts.TorExitList)
+		go exits.Watch(opts.TorRefresh, func(err error) {
+			log.Printf("Failed to refresh Tor exit list: %s", err)
+		})
+		server.TorExit = exits.Contains
+	}
+	if opts.Bogons {
+		bogons := bogon.New()
+		if opts.BogonList != "" {
+			if err := bogons.LoadFile(opts.BogonList); err != nil {
+				log.Fatal(err)
+			}
+		}
+		log.Printf("Flagging IPs in %d bogon prefixes", bogons.Len())
+		server.Bogon = bogons.Contains
+	}
+	if opts.CDN != "" {
+		ranges, err := cdn.New(opts.CDN)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Trusting requests from %s IP ranges", opts.CDN)
+		go ranges.Watch(opts.CDNRefresh, func(err error) {
+			log.Printf("Failed to refresh %s IP ranges: %s", opts.CDN, err)
+		})
+		if opts.IPHeader == "" {
+			opts.IPHeader = ranges.Header
+			server.IPHeader = ranges.Header
+		}
+		server.TrustedProxy = ranges.Contains
+	}
+	trustedProxies, err := iputil.ParseNetworks(opts.TrustedProxies)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(trustedProxies) > 0 {
+		log.Printf("Trusting headers from %d trusted proxy network(s)", len(trustedProxies))
+		cdnTrusted := server.TrustedProxy
+		server.TrustedProxy = func(ip net.IP) bool {
+			if cdnTrusted != nil && cdnTrusted(ip) {
+				return true
+			}
+			for _, n := range trustedProxies {
+				if n.Contains(ip) {
+					return true
+				}
+			}
+			return false
+		}
+	}
+	if opts.ForwardedURL && server.TrustedProxy == nil {
+		log.Fatal("Trusting forwarded URL headers requires at least one trusted proxy")
+	}
 	if opts.IPHeader != "" {
 		log.Printf("Trusting header %s to contain correct remote IP", opts.IPHeader)
 	}
+	if opts.PortHeader != "" {
+		log.Printf("Trusting header %s to contain correct source port", opts.PortHeader)
+	}
+	if opts.RateLimit > 0 {
+		exempt, err := iputil.ParseNetworks(opts.RateLimitExempt)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Limiting clients to %d requests per minute", opts.RateLimit)
+		server.RateLimit = opts.RateLimit
+		server.RateLimitBurst = opts.RateLimitBurst
+		server.RateLimitExempt = exempt
+	}
+	if opts.SecurityHeaders {
+		log.Println("Enabling security headers")
+		server.SecurityHeaders = true
+	}
+	if opts.Gzip {
+		log.Printf("Compressing responses of at least %d bytes", opts.MinCompressSize)
+		server.Gzip = true
+		server.MinCompressSize = opts.MinCompressSize
+	}
+	if opts.AccessLog != "" {
+		log.Printf("Writing access log in %s format", opts.AccessLog)
+		server.AccessLog = os.Stdout
+		server.AccessLogFormat = opts.AccessLog
+		server.AnonymizeLog = opts.AnonymizeLog
+	}
+
+	listener, err := net.Listen("tcp", opts.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if opts.ProxyProtocol {
+		if len(trustedProxies) == 0 {
+			log.Fatal("PROXY protocol requires at least one trusted proxy")
+		}
+		log.Printf("Reading PROXY protocol header from %d trusted network(s)", len(trustedProxies))
+		listener = &proxyproto.Listener{Listener: listener, Trusted: trustedProxies}
+	}
+
+	scheme := "http"
+	if opts.TLSCert != "" || opts.TLSKey != "" {
+		cert, err := tls.LoadX509KeyPair(opts.TLSCert, opts.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if opts.JA3 {
+			log.Println("Including JA3 fingerprint of TLS clients")
+			listener = &ja3.Listener{Listener: listener}
+			server.JA3 = ja3.Fingerprint
+		}
+		listener = tls.NewListener(listener, &tls.Config{Certificates: []tls.Certificate{cert}})
+		scheme = "https"
+		if opts.HTTP3Listen != "" {
+			_, port, err := net.SplitHostPort(opts.HTTP3Listen)
+			if err != nil {
+				log.Fatal(err)
+			}
+			if server.HTTP3Port, err = strconv.Atoi(port); err != nil {
+				log.Fatalf("Invalid HTTP/3 port: %s", port)
+			}
+		}
+	} else if opts.JA3 {
+		log.Fatal("JA3 fingerprinting requires TLS")
+	} else if opts.HTTP3Listen != "" {
+		log.Fatal("HTTP/3 requires TLS")
+	}
+	server.ServerName = opts.ServerName
 
-	log.Printf("Listening on http://%s", opts.Listen)
-	if err := server.ListenAndServe(opts.Listen); err != nil {
+	// The server must be fully configured at this point, as listeners start serving requests concurrently
+	if opts.AdminListen != "" {
+		log.Printf("Listening for admin requests on http://%s", opts.AdminListen)
+		go func() {
+			if err := server.ServeAdmin(opts.AdminListen); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if opts.HTTP3Listen != "" {
+		log.Printf("Listening on https://%s using HTTP/3", opts.HTTP3Listen)
+		go func() {
+			if err := server.ListenAndServeQUIC(opts.HTTP3Listen, opts.TLSCert, opts.TLSKey); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
+	log.Printf("Listening on %s://%s", scheme, opts.Listen)
+	if err := server.Serve(listener); err != nil {
 		log.Fatal(err)
 	}
 }
@@ -0,0 +1,121 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+// responseFields returns the JSON names of all fields in Response, in declaration order. Fields not written as JSON,
+// which are declared last, are excluded.
+func responseFields() []string {
+	t := reflect.TypeOf(Response{})
+	fields := make([]string, 0, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if name == "-" {
+			continue
+		}
+		fields = append(fields, name)
+	}
+	return fields
+}
+
+// responseFieldIndex returns the index of each field of Response in the struct, keyed by its JSON name.
+func responseFieldIndex() map[string]int {
+	t := reflect.TypeOf(Response{})
+	index := make(map[string]int, t.NumField())
+	for i := 0; i < t.NumField(); i++ {
+		if name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]; name != "-" {
+			index[name] = i
+		}
+	}
+	return index
+}
+
+// ValidateFields returns an error if any of fields is not a field of Response.
+func ValidateFields(fields []string) error {
+	valid := make(map[string]bool)
+	for _, f := range responseFields() {
+		valid[f] = true
+	}
+	for _, f := range fields {
+		if !valid[f] {
+			return fmt.Errorf("invalid field: %s (valid fields are %s)", f, strings.Join(responseFields(), ", "))
+		}
+	}
+	return nil
+}
+
+func formatField(v reflect.Value) string {
+	switch x := v.Interface().(type) {
+	case net.IP:
+		return x.String()
+	case []net.IP:
+		ips := make([]string, len(x))
+		for i, ip := range x {
+			ips[i] = ip.String()
+		}
+		return strings.Join(ips, ", ")
+	}
+	if v.Kind() == reflect.Ptr {
+		return fmt.Sprint(v.Elem().Interface())
+	}
+	return fmt.Sprint(v.Interface())
+}
+
+func (s *Server) CLIAllHandler(w http.ResponseWriter, r *http.Request) *appError {
+	response, err := s.newResponse(r)
+	if err != nil {
+		return responseError(err)
+	}
+	s.writeAll(w, response)
+	return nil
+}
+
+// ipAllPath returns the IP in path if it is on the form /IP/all.
+func ipAllPath(path string) (net.IP, bool) {
+	if !strings.HasPrefix(path, "/") || !strings.HasSuffix(path, "/all") {
+		return nil, false
+	}
+	ip := net.ParseIP(path[1 : len(path)-len("/all")])
+	return ip, ip != nil
+}
+
+// IPAllHandler writes all fields for the IP given in the path, like CLIAllHandler does for the IP of the client.
+func (s *Server) IPAllHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ip, ok := ipAllPath(r.URL.Path)
+	if !ok {
+		return NotFoundHandler(w, r)
+	}
+	response, err := s.ipResponse(r, ip)
+	if err != nil {
+		return responseError(err)
+	}
+	s.enrich(ip, &response)
+	s.writeAll(w, response)
+	return nil
+}
+
+func (s *Server) writeAll(w http.ResponseWriter, response Response) {
+	fields := s.AllFields
+	if len(fields) == 0 {
+		fields = responseFields()
+	}
+	v := reflect.ValueOf(response)
+	index := responseFieldIndex()
+	w.Header().Set("Content-Type", s.textContentType())
+	for _, name := range fields {
+		i, ok := index[name]
+		if !ok {
+			continue
+		}
+		field := v.Field(i)
+		if field.IsZero() {
+			continue
+		}
+		fmt.Fprintf(w, "%s: %s\n", name, formatField(field))
+	}
+}
@@ -0,0 +1,101 @@
+package http
+
+import (
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+)
+
+const (
+	maxBatchSize = 10 << 20
+	maxBatchRows = 100000
+)
+
+// batchTruncatedHeader is the trailer set when only some rows are answered. Rows are streamed, so the status can no
+// longer be changed when this is detected.
+const batchTruncatedHeader = "X-Batch-Truncated"
+
+var batchColumns = []string{"country", "country_iso", "city", "asn"}
+
+func (s *Server) batchColumns(ip net.IP) []string {
+	if ip == nil {
+		return make([]string, len(batchColumns))
+	}
+	record, _ := s.lookup(ip)
+	var asn string
+	if record.ISP.ASN > 0 {
+		asn = strconv.FormatUint(uint64(record.ISP.ASN), 10)
+	}
+	return []string{record.Country.Name, record.Country.ISO, record.City, asn}
+}
+
+func (s *Server) BatchCSVHandler(w http.ResponseWriter, r *http.Request) *appError {
+	column := 0
+	if v := r.URL.Query().Get("column"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			return badRequest(err).WithMessage(fmt.Sprintf("Invalid column: %s\n", v))
+		}
+		column = n
+	}
+	reader := csv.NewReader(http.MaxBytesReader(w, r.Body, maxBatchSize))
+	reader.FieldsPerRecord = -1
+	writer := csv.NewWriter(w)
+	flusher, _ := w.(http.Flusher)
+	flush := func() { // Stream rows as they are produced instead of buffering the whole response
+		writer.Flush()
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	// Rows exceeding maxBatchRows, or read after the request deadline, are not answered
+	truncated := false
+	for i := 0; ; i++ {
+		if r.Context().Err() != nil {
+			truncated = true
+			break
+		}
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if i == maxBatchRows {
+			truncated = true
+			break
+		}
+		if err != nil {
+			if i == 0 {
+				return badRequest(err).WithMessage("Invalid CSV\n")
+			}
+			truncated = true // Output may already have been sent, so the best we can do is to truncate it
+			break
+		}
+		if column >= len(record) {
+			if i == 0 {
+				return badRequest(nil).WithMessage(fmt.Sprintf("Column %d does not exist\n", column))
+			}
+			writer.Write(append(record, s.batchColumns(nil)...))
+			flush()
+			continue
+		}
+		ip := net.ParseIP(record[column])
+		if i == 0 {
+			w.Header().Set("Content-Type", csvMediaType+charsetUTF8)
+			w.Header().Set("Trailer", batchTruncatedHeader)
+			if ip == nil { // Treat first row as header
+				writer.Write(append(record, batchColumns...))
+				flush()
+				continue
+			}
+		}
+		writer.Write(append(record, s.batchColumns(ip)...))
+		flush()
+	}
+	if truncated {
+		w.Header().Set(batchTruncatedHeader, "true")
+	}
+	return nil
+}
@@ -0,0 +1,37 @@
+package http
+
+import "net/http"
+
+// DebugRoute describes a route of the handler returned by Handler.
+type DebugRoute struct {
+	Method    string `json:"method"`
+	Path      string `json:"path"`
+	Prefix    bool   `json:"prefix,omitempty"`
+	Condition string `json:"condition,omitempty"`
+}
+
+type DebugRoutesResponse struct {
+	Routes []DebugRoute `json:"routes"`
+}
+
+// DebugRoutesHandler lists the routes of the handler returned by Handler, in order of precedence. Which routes are
+// registered depends on configuration and loaded databases, so this explains why a given path is not found.
+func (s *Server) DebugRoutesHandler(w http.ResponseWriter, r *http.Request) *appError {
+	s.routesMu.RLock()
+	routes := make([]DebugRoute, 0, len(s.routes))
+	for _, route := range s.routes {
+		condition := route.condition
+		if condition == "" && route.matcherFunc != nil {
+			condition = "custom"
+		}
+		routes = append(routes, DebugRoute{Method: route.method, Path: route.path, Prefix: route.prefix,
+			Condition: condition})
+	}
+	s.routesMu.RUnlock()
+	b, err := s.marshalIndentJSON(DebugRoutesResponse{Routes: routes})
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
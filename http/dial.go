@@ -0,0 +1,68 @@
+package http
+
+import (
+	"net"
+	"sync"
+)
+
+const (
+	defaultMaxDials       = 64
+	defaultMaxClientDials = maxPortConcurrency
+)
+
+// dialLimiter limits the number of concurrent outbound dials made for port tests, in total and per client, so that
+// clients cannot use port testing to make us scan on their behalf.
+type dialLimiter struct {
+	mu        sync.Mutex
+	max       int // 0 for no limit
+	perClient int // 0 for no limit
+	active    int
+	clients   map[string]int
+}
+
+func newDialLimiter(max, perClient int) *dialLimiter {
+	return &dialLimiter{max: max, perClient: perClient, clients: make(map[string]int)}
+}
+
+// acquire reserves up to n dials for ip and returns the number reserved, which is 0 if the client or the server is
+// at its limit.
+func (l *dialLimiter) acquire(ip net.IP, n int) int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := ip.String()
+	if l.max > 0 && l.active+n > l.max {
+		n = l.max - l.active
+	}
+	if l.perClient > 0 && l.clients[key]+n > l.perClient {
+		n = l.perClient - l.clients[key]
+	}
+	if n <= 0 {
+		return 0
+	}
+	l.active += n
+	l.clients[key] += n
+	return n
+}
+
+func (l *dialLimiter) release(ip net.IP, n int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := ip.String()
+	l.active -= n
+	if l.clients[key] -= n; l.clients[key] <= 0 {
+		delete(l.clients, key)
+	}
+}
+
+// acquireDials reserves up to n dials for ip, returning the number reserved and a function releasing them. An error
+// is returned if no dials could be reserved.
+func (s *Server) acquireDials(ip net.IP, n int) (int, func(), error) {
+	if s.dials == nil {
+		return n, func() {}, nil
+	}
+	reserved := s.dials.acquire(ip, n)
+	if reserved == 0 {
+		return 0, nil, errTooManyDials
+	}
+	return reserved, func() { s.dials.release(ip, reserved) }, nil
+}
@@ -1,12 +1,23 @@
 package http
 
-import "net/http"
+import (
+	"errors"
+	"net/http"
+)
+
+var (
+	errTooManyLookups = errors.New("too many concurrent lookups")
+	errTooManyDials   = errors.New("too many concurrent port tests")
+	errNonASCIIPort   = errors.New("port contains non-ASCII digits")
+	errInvalidIP      = errors.New("could not determine client IP")
+)
 
 type appError struct {
 	Error       error
 	Message     string
 	Code        int
 	ContentType string
+	Header      http.Header
 }
 
 func internalServerError(err error) *appError {
@@ -25,6 +36,52 @@ func badRequest(err error) *appError {
 	return &appError{Error: err, Code: http.StatusBadRequest}
 }
 
+func unauthorized(err error) *appError {
+	return &appError{Error: err, Message: "401 unauthorized", Code: http.StatusUnauthorized}
+}
+
+func methodNotAllowed(err error) *appError {
+	return &appError{Error: err, Message: "405 method not allowed", Code: http.StatusMethodNotAllowed}
+}
+
+func notImplemented(err error) *appError {
+	return &appError{Error: err, Code: http.StatusNotImplemented}
+}
+
+func payloadTooLarge(err error) *appError {
+	return &appError{Error: err, Code: http.StatusRequestEntityTooLarge}
+}
+
+func misdirectedRequest(err error) *appError {
+	return &appError{Error: err, Code: http.StatusMisdirectedRequest}
+}
+
+func tooManyRequests(err error) *appError {
+	return &appError{Error: err, Message: "429 too many requests", Code: http.StatusTooManyRequests}
+}
+
+func serviceUnavailable(err error) *appError {
+	return &appError{
+		Error:   err,
+		Message: "Service unavailable",
+		Code:    http.StatusServiceUnavailable,
+	}
+}
+
+func responseError(err error) *appError {
+	if err == errTooManyLookups {
+		return serviceUnavailable(err).WithHeader("Retry-After", "1")
+	}
+	if err == errTooManyDials {
+		return tooManyRequests(err).WithHeader("Retry-After", "1")
+	}
+	// A missing or malformed address is caused by the client or a proxy in front of us
+	if errors.Is(err, errInvalidIP) {
+		return badRequest(err).WithMessage("400 bad request")
+	}
+	return internalServerError(err)
+}
+
 func (e *appError) AsJSON() *appError {
 	e.ContentType = jsonMediaType
 	return e
@@ -35,6 +92,14 @@ func (e *appError) WithMessage(message string) *appError {
 	return e
 }
 
+func (e *appError) WithHeader(key, value string) *appError {
+	if e.Header == nil {
+		e.Header = make(http.Header)
+	}
+	e.Header.Set(key, value)
+	return e
+}
+
 func (e *appError) IsJSON() bool {
 	return e.ContentType == jsonMediaType
 }
@@ -0,0 +1,49 @@
+package http
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const (
+	eventStreamMediaType = "text/event-stream"
+	defaultMaxStreams    = 64
+)
+
+var errTooManyStreams = errors.New("too many concurrent event streams")
+
+// EventsHandler sends the IP of the client as a server-sent event every EventInterval, until the client disconnects.
+// The IP of a connection never changes, but clients reconnecting after a network change receive their new IP.
+func (s *Server) EventsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		return internalServerError(errors.New("response writer does not support flushing"))
+	}
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err)
+	}
+	if s.streams != nil {
+		select {
+		case s.streams <- struct{}{}:
+			defer func() { <-s.streams }()
+		default:
+			return serviceUnavailable(errTooManyStreams).WithHeader("Retry-After", "60")
+		}
+	}
+	w.Header().Set("Content-Type", eventStreamMediaType+charsetUTF8)
+	w.Header().Set("Cache-Control", "no-cache")
+	ticker := time.NewTicker(s.EventInterval)
+	defer ticker.Stop()
+	for {
+		fmt.Fprintf(w, "data: %s\n\n", ip)
+		flusher.Flush()
+		select {
+		case <-r.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package http
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"net/http"
+
+	"github.com/mpolden/ipd/iputil"
+)
+
+type FormatsResponse struct {
+	IP          net.IP `json:"ip"`
+	Decimal     string `json:"decimal"`
+	Hex         string `json:"hex"`
+	Binary      string `json:"binary"`
+	ReverseName string `json:"reverse_name"`
+}
+
+// newFormatsResponse returns ip in several representations. The decimal form is a string, as IPv6 addresses do not
+// fit in JSON numbers.
+func newFormatsResponse(ip net.IP) FormatsResponse {
+	b := ip.To4()
+	if b == nil {
+		b = ip.To16()
+	}
+	i := new(big.Int).SetBytes(b)
+	return FormatsResponse{
+		IP:          ip,
+		Decimal:     i.String(),
+		Hex:         fmt.Sprintf("0x%0*x", len(b)*2, i),
+		Binary:      fmt.Sprintf("%0*b", len(b)*8, i),
+		ReverseName: iputil.ReverseName(ip),
+	}
+}
+
+func (s *Server) FormatsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err).AsJSON()
+	}
+	b, err := s.marshalJSON(newFormatsResponse(ip))
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
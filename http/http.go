@@ -1,10 +1,16 @@
 package http
 
 import (
+	"bytes"
+	"context"
+	"crypto/subtle"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
-	"path/filepath"
+	"io"
+	"io/ioutil"
+	"math"
 
 	"github.com/mpolden/ipd/iputil"
 	"github.com/mpolden/ipd/iputil/database"
@@ -12,191 +18,1212 @@ import (
 
 	"net"
 	"net/http"
+	"sort"
 	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	texttemplate "text/template"
+	"time"
+	"unicode"
 )
 
 const (
 	jsonMediaType = "application/json"
 	textMediaType = "text/plain"
+	htmlMediaType = "text/html"
+	csvMediaType  = "text/csv"
+	charsetUTF8   = "; charset=utf-8"
+
+	jsonContentType = jsonMediaType + charsetUTF8
+)
+
+const contentSecurityPolicy = "default-src 'none'; " +
+	"style-src 'unsafe-inline' https://fonts.googleapis.com https://cdnjs.cloudflare.com; " +
+	"font-src https://fonts.gstatic.com; img-src 'self'; base-uri 'none'; form-action 'none'; frame-ancestors 'none'"
+
+const (
+	RootJSON = "json" // Accept header is application/json
+	RootCLI  = "cli"  // User agent is a known command line client
+	RootText = "text" // Accept header is text/plain
+)
+
+var defaultRootOrder = []string{RootJSON, RootCLI, RootText}
+
+const (
+	maxPingAttempts      = 5
+	defaultAPIKeyHeader  = "X-API-Key"
+	defaultMaxLookups    = 256
+	defaultMaxPathLength = 1024
 )
 
 type Server struct {
-	Template   string
-	IPHeader   string
-	LookupAddr func(net.IP) (string, error)
-	LookupPort func(net.IP, uint64) error
-	db         database.Client
+	Template         string
+	HostTemplates    map[string]string
+	HostLanguages    map[string]string
+	ErrorTemplate    string
+	CLITemplate      string
+	UnknownCountry   string
+	IPHeader         string
+	TrustedHops      int
+	ForwardedURL     bool
+	PortHeader       string
+	LookupAddr       func(context.Context, net.IP) (string, error)
+	LookupPort       func(net.IP, uint64) error
+	LookupHost       func(string) ([]net.IP, error)
+	TorExit          func(net.IP) bool
+	Bogon            func(net.IP) bool
+	TrustedProxy     func(net.IP) bool
+	JA3              func(net.Conn) string
+	Enrich           func(net.IP, *Response)
+	AccessLog        io.Writer
+	AccessLogFormat  string
+	AnonymizeLog     bool
+	MaxLookups       int
+	MaxStreams       int
+	MaxDials         int
+	MaxClientDials   int
+	HTTP3Port        int
+	EventInterval    time.Duration
+	RateLimit        int
+	RateLimitBurst   int
+	RateLimitExempt  []*net.IPNet
+	RateLimiter      RateLimiter
+	DecimalString    bool
+	PortString       bool
+	SourcePort       bool
+	SecurityHeaders  bool
+	Gzip             bool
+	MinCompressSize  int
+	DisabledRoutes   []string
+	RootOrder        []string
+	MaxPathLength    int
+	RequestTimeout   time.Duration
+	AllFields        []string
+	NoContent        bool
+	TextContentType  string
+	AllowedHosts     []string
+	GeoOverrides     []GeoOverride
+	RequireUserAgent bool
+	RedirectHTTPS    bool
+	IPResponseHeader bool
+	IPLookup         bool
+	DevMode          bool
+	RawLookup        bool
+	Batch            bool
+	Speed            bool
+	Network          bool
+	ServerHostname   string
+	PoP              string
+	Region           string
+	CamelCase        bool
+	NullFields       bool
+	CountryFlag      bool
+	OpenAPI          bool
+	Resolve          bool
+	ResolveRateLimit int
+	VerifyHostname   bool
+	StripSuffixes    []string
+	ServerName       bool
+	Timestamp        bool
+	ReverseName      bool
+	SigningKey       []byte
+	APIKeys          []string
+	APIKeyHeader     string
+	Addr             string
+	FixedResponse    *Response
+	DegradeOnDBError bool
+	db               database.Client
+	lookups          chan struct{}
+	dials            *dialLimiter
+	streams          chan struct{}
+	templateMu       sync.Mutex
+	templates        map[string]*template.Template
+	cliTemplate      *texttemplate.Template
+	handlerOnce      sync.Once
+	handler          http.Handler
+	routesMu         sync.RWMutex
+	routes           []*route
 }
 
 type Response struct {
-	IP         net.IP `json:"ip"`
-	IPDecimal  uint64 `json:"ip_decimal"`
-	Country    string `json:"country,omitempty"`
-	CountryISO string `json:"country_iso,omitempty"`
-	City       string `json:"city,omitempty"`
-	Hostname   string `json:"hostname,omitempty"`
+	IP                net.IP   `json:"ip"`
+	IPDecimal         uint64   `json:"ip_decimal"`
+	Family            int      `json:"family"`
+	Country           string   `json:"country,omitempty"`
+	CountryISO        string   `json:"country_iso,omitempty"`
+	CountryFlag       string   `json:"country_flag,omitempty"`
+	City              string   `json:"city,omitempty"`
+	CountryConfidence uint8    `json:"country_confidence,omitempty"`
+	CityConfidence    uint8    `json:"city_confidence,omitempty"`
+	Hostname          string   `json:"hostname,omitempty"`
+	HostnameVerified  *bool    `json:"hostname_verified,omitempty"`
+	ReverseName       string   `json:"reverse_name,omitempty"`
+	ISP               string   `json:"isp,omitempty"`
+	ConnectionType    string   `json:"connection_type,omitempty"`
+	MobileCountryCode string   `json:"mobile_country_code,omitempty"`
+	MobileNetworkCode string   `json:"mobile_network_code,omitempty"`
+	Network           string   `json:"network,omitempty"`
+	ASNNetwork        string   `json:"asn_network,omitempty"`
+	IsTorExit         *bool    `json:"is_tor_exit,omitempty"`
+	IsBogon           *bool    `json:"is_bogon,omitempty"`
+	PossibleProxyIP   *bool    `json:"possible_proxy_ip,omitempty"`
+	SourcePort        uint16   `json:"source_port,omitempty"`
+	ForwardedChain    []net.IP `json:"forwarded_chain,omitempty"`
+	ViaProxy          *bool    `json:"via_proxy,omitempty"`
+	ServerName        string   `json:"server_name,omitempty"`
+	JA3               string   `json:"ja3,omitempty"`
+	Timestamp         string   `json:"timestamp,omitempty"`
+	// Location is the coordinates of IP, used for rendering the map on the HTML page
+	Location database.Location `json:"-"`
+	// Extra holds fields added by Server.Enrich, which are written inline in JSON responses
+	Extra map[string]interface{} `json:"-"`
+}
+
+type stringDecimalResponse struct {
+	Response
+	IPDecimal uint64 `json:"ip_decimal,string"`
+}
+
+type stringPortResponse struct {
+	PortResponse
+	Port uint64 `json:"port,string"`
+}
+
+type DistanceResponse struct {
+	IP        net.IP  `json:"ip"`
+	Latitude  float64 `json:"latitude"`
+	Longitude float64 `json:"longitude"`
+	Distance  float64 `json:"distance_km"`
 }
 
 type PortResponse struct {
-	IP        net.IP `json:"ip"`
-	Port      uint64 `json:"port"`
-	Reachable bool   `json:"reachable"`
+	IP        net.IP  `json:"ip"`
+	Port      uint64  `json:"port"`
+	Reachable bool    `json:"reachable"`
+	RTT       float64 `json:"rtt_ms,omitempty"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type ResolveResponse struct {
+	Hostname string   `json:"hostname"`
+	IPs      []net.IP `json:"ips"`
+}
+
+// OpenDatabase replaces the database used for lookups with the one returned by open. If open fails and
+// DegradeOnDBError is set, the server runs without geo lookups instead. The error is returned in both cases.
+func (s *Server) OpenDatabase(open func() (database.Client, error)) error {
+	db, err := open()
+	if err == nil {
+		s.db = db
+		return nil
+	}
+	if s.DegradeOnDBError {
+		empty, emptyErr := database.New("", "", "", "")
+		if emptyErr != nil {
+			return emptyErr
+		}
+		s.db = empty
+	}
+	return err
 }
 
 func New(db database.Client) *Server {
-	return &Server{db: db}
+	return &Server{db: db, MaxLookups: defaultMaxLookups, MinCompressSize: defaultMinCompressSize,
+		MaxPathLength: defaultMaxPathLength, MaxStreams: defaultMaxStreams, MaxDials: defaultMaxDials,
+		MaxClientDials: defaultMaxClientDials}
 }
 
-func ipFromRequest(header string, r *http.Request) (net.IP, error) {
+// forwardedNode returns the node of the for parameter in the last element of a Forwarded header (RFC 7239), which is
+// the element added by the proxy closest to us.
+func forwardedNode(value string) string {
+	elements := strings.Split(value, ",")
+	for _, pair := range strings.Split(elements[len(elements)-1], ";") {
+		kv := strings.SplitN(strings.TrimSpace(pair), "=", 2)
+		if len(kv) == 2 && strings.EqualFold(kv[0], "for") {
+			return strings.Trim(kv[1], `"`)
+		}
+	}
+	return ""
+}
+
+// forwardedFor returns the IP of the node returned by forwardedNode, without any port.
+func forwardedFor(value string) string {
+	node := forwardedNode(value)
+	if strings.HasPrefix(node, "[") {
+		if i := strings.Index(node, "]"); i > 0 {
+			return node[1:i]
+		}
+		return node
+	}
+	if host, _, err := net.SplitHostPort(node); err == nil {
+		return host
+	}
+	return node
+}
+
+// forwardedChain returns the IP addresses of all hops found in the Forwarded header, or the X-Forwarded-For header if
+// the former is not present.
+func forwardedChain(r *http.Request) []net.IP {
+	if chain := headerChain(r, "Forwarded"); len(chain) > 0 {
+		return chain
+	}
+	return headerChain(r, "X-Forwarded-For")
+}
+
+// headerChain returns the IP addresses of all hops found in header, which is either Forwarded or X-Forwarded-For.
+func headerChain(r *http.Request, header string) []net.IP {
+	forwarded := strings.EqualFold(header, "Forwarded")
+	var chain []net.IP
+	for _, value := range r.Header.Values(header) {
+		for _, hop := range strings.Split(value, ",") {
+			if forwarded {
+				hop = forwardedFor(hop)
+			}
+			if ip := net.ParseIP(strings.TrimSpace(hop)); ip != nil {
+				chain = append(chain, ip)
+			}
+		}
+	}
+	return chain
+}
+
+// trustedForwardedChain returns the forwarded chain of r, if its headers can be trusted. This is the case when the
+// peer is a trusted proxy, or when the chain is read from the trusted IP header.
+func (s *Server) trustedForwardedChain(r *http.Request) []net.IP {
+	if s.trustedPeer(r) {
+		return forwardedChain(r)
+	}
+	if strings.EqualFold(s.IPHeader, "Forwarded") || strings.EqualFold(s.IPHeader, "X-Forwarded-For") {
+		return headerChain(r, s.IPHeader)
+	}
+	return nil
+}
+
+// clientHop returns the hop just left of the trustedHops rightmost hops in the comma-separated list value, or the
+// leftmost hop if the list is shorter.
+func clientHop(value string, trustedHops int) string {
+	hops := strings.Split(value, ",")
+	i := len(hops) - 1 - trustedHops
+	if i < 0 {
+		i = 0
+	}
+	return strings.TrimSpace(hops[i])
+}
+
+// ipFromRequest returns the IP of the client making request r, and whether it was read from the trusted header rather
+// than the address of the peer. If header is X-Forwarded-For or Forwarded, the trustedHops rightmost hops are skipped.
+func ipFromRequest(header string, trustedHops int, r *http.Request) (net.IP, bool, error) {
 	remoteIP := r.Header.Get(header)
-	if remoteIP == "" {
+	if strings.EqualFold(header, "Forwarded") && remoteIP != "" {
+		remoteIP = forwardedFor(clientHop(strings.Join(r.Header[http.CanonicalHeaderKey(header)], ","), trustedHops))
+	}
+	if strings.EqualFold(header, "X-Forwarded-For") && remoteIP != "" {
+		remoteIP = clientHop(strings.Join(r.Header[http.CanonicalHeaderKey(header)], ","), trustedHops)
+	}
+	if strings.EqualFold(header, "CloudFront-Viewer-Address") && remoteIP != "" {
+		// Always includes the port, also for unbracketed IPv6 addresses, e.g. 2001:db8::1:443
+		if i := strings.LastIndex(remoteIP, ":"); i > 0 {
+			remoteIP = remoteIP[:i]
+		}
+	}
+	viaProxy := remoteIP != ""
+	if !viaProxy {
 		host, _, err := net.SplitHostPort(r.RemoteAddr)
 		if err != nil {
-			return nil, err
+			return nil, false, fmt.Errorf("%w: %s", errInvalidIP, err)
 		}
 		remoteIP = host
 	}
 	ip := net.ParseIP(remoteIP)
 	if ip == nil {
-		return nil, fmt.Errorf("could not parse IP: %s", remoteIP)
+		return nil, false, fmt.Errorf("%w: could not parse IP: %s", errInvalidIP, remoteIP)
 	}
-	return ip, nil
+	return ip, viaProxy, nil
+}
+
+// sourcePort returns the source port of the client making request r, or 0 if it is unknown. When the client IP is read
+// from IPHeader, the port is read from the same header if it has one, as Forwarded and CloudFront-Viewer-Address can.
+// Otherwise it is read from PortHeader, if set, and finally from the address of the peer if the peer is the client.
+// This is also the case when the PROXY protocol is used, as the peer address is then that of the client.
+func (s *Server) sourcePort(r *http.Request) uint16 {
+	var port string
+	_, viaProxy, _ := ipFromRequest(s.IPHeader, s.TrustedHops, r)
+	if viaProxy {
+		value := r.Header.Get(s.IPHeader)
+		switch {
+		case strings.EqualFold(s.IPHeader, "Forwarded"):
+			node := forwardedNode(clientHop(strings.Join(r.Header.Values(s.IPHeader), ","), s.TrustedHops))
+			_, port, _ = net.SplitHostPort(node)
+		case strings.EqualFold(s.IPHeader, "CloudFront-Viewer-Address"):
+			if i := strings.LastIndex(value, ":"); i > 0 {
+				port = value[i+1:]
+			}
+		}
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil && s.PortHeader != "" {
+		elements := strings.Split(r.Header.Get(s.PortHeader), ",")
+		port = strings.TrimSpace(elements[len(elements)-1])
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil && !viaProxy {
+		_, port, _ = net.SplitHostPort(r.RemoteAddr)
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return 0
+	}
+	return uint16(p)
+}
+
+func countryFlag(iso string) string {
+	if len(iso) != 2 {
+		return ""
+	}
+	var flag []rune
+	for _, c := range strings.ToUpper(iso) {
+		if c < 'A' || c > 'Z' {
+			return ""
+		}
+		// Regional indicator symbols start at U+1F1E6 (A)
+		flag = append(flag, 0x1f1e6+c-'A')
+	}
+	return string(flag)
+}
+
+// approximateNetwork returns network in CIDR notation, or the /24 or /48 network containing ip if network is nil.
+func approximateNetwork(ip net.IP, network *net.IPNet) string {
+	if network != nil {
+		return network.String()
+	}
+	mask := net.CIDRMask(24, 32)
+	if ip.To4() == nil {
+		mask = net.CIDRMask(48, 128)
+	} else {
+		ip = ip.To4()
+	}
+	return (&net.IPNet{IP: ip.Mask(mask), Mask: mask}).String()
+}
+
+// clientIP returns the IP address of the client making request r, or the IP of FixedResponse if set.
+func (s *Server) clientIP(r *http.Request) (net.IP, error) {
+	if s.FixedResponse != nil {
+		return s.FixedResponse.IP, nil
+	}
+	ip, _, err := ipFromRequest(s.IPHeader, s.TrustedHops, r)
+	return ip, err
+}
+
+// portTargetIP returns the IP to dial when testing ports for request r. This is always the address of the peer, which
+// is the client unless we are behind a proxy not using the PROXY protocol, so that clients cannot make us dial other
+// hosts by sending a header.
+func portTargetIP(r *http.Request) (net.IP, error) {
+	ip, _, err := ipFromRequest("", 0, r)
+	return ip, err
+}
+
+// stripSuffix removes the first matching domain in suffixes from hostname. A hostname equal to a suffix is kept as is.
+func stripSuffix(hostname string, suffixes []string) string {
+	for _, suffix := range suffixes {
+		suffix = "." + strings.Trim(suffix, ".")
+		name := strings.TrimSuffix(hostname, ".")
+		if len(name) > len(suffix) && strings.EqualFold(name[len(name)-len(suffix):], suffix) {
+			return name[:len(name)-len(suffix)]
+		}
+	}
+	return hostname
 }
 
 func (s *Server) newResponse(r *http.Request) (Response, error) {
-	ip, err := ipFromRequest(s.IPHeader, r)
+	if s.FixedResponse != nil {
+		return *s.FixedResponse, nil
+	}
+	ip, viaProxy, err := ipFromRequest(s.IPHeader, s.TrustedHops, r)
 	if err != nil {
 		return Response{}, err
 	}
+	response, err := s.ipResponse(r, ip)
+	if err != nil {
+		return Response{}, err
+	}
+	// Fields describing the connection of the client rather than its IP
+	if s.IPHeader != "" { // Only meaningful when a trusted header is configured
+		response.ViaProxy = &viaProxy
+	}
+	if s.SourcePort {
+		response.SourcePort = s.sourcePort(r)
+	}
+	response.ForwardedChain = s.trustedForwardedChain(r)
+	if s.ServerName {
+		response.ServerName = serverName(r)
+	}
+	if s.JA3 != nil && r.TLS != nil {
+		if c, ok := r.Context().Value(connContextKey{}).(net.Conn); ok {
+			response.JA3 = s.JA3(c)
+		}
+	}
+	s.enrich(ip, &response)
+	return response, nil
+}
+
+// enrich calls Enrich, if set, to let it modify response before it is written.
+func (s *Server) enrich(ip net.IP, response *Response) {
+	if s.Enrich != nil {
+		s.Enrich(ip, response)
+	}
+}
+
+// ipResponse returns the information about ip which does not depend on how the client is connected.
+func (s *Server) ipResponse(r *http.Request, ip net.IP) (Response, error) {
+	if s.lookups != nil {
+		select {
+		case s.lookups <- struct{}{}:
+			defer func() { <-s.lookups }()
+		default:
+			return Response{}, errTooManyLookups
+		}
+	}
 	ipDecimal := iputil.ToDecimal(ip)
-	country, _ := s.db.Country(ip)
-	city, _ := s.db.City(ip)
+	record, _ := s.lookup(ip)
+	if languages := s.languages(r); len(languages) > 0 {
+		if name := localizedName(record.CountryNames, languages); name != "" {
+			record.Country.Name = name
+		}
+		if name := localizedName(record.CityNames, languages); name != "" {
+			record.City = name
+		}
+	}
 	var hostname string
 	if s.LookupAddr != nil {
-		hostname, _ = s.LookupAddr(ip)
+		hostname, _ = s.LookupAddr(r.Context(), ip)
+	}
+	var hostnameVerified *bool
+	if s.VerifyHostname && s.LookupHost != nil && hostname != "" {
+		b := s.forwardConfirmed(hostname, ip)
+		hostnameVerified = &b
+	}
+	hostname = stripSuffix(hostname, s.StripSuffixes)
+	var isTorExit *bool
+	if s.TorExit != nil {
+		b := s.TorExit(ip)
+		isTorExit = &b
+	}
+	var isBogon *bool
+	if s.Bogon != nil {
+		b := s.Bogon(ip)
+		isBogon = &b
+	}
+	var flag string
+	if s.CountryFlag {
+		flag = countryFlag(record.Country.ISO)
+	}
+	var network string
+	if s.Network {
+		network = approximateNetwork(ip, record.Network)
+	}
+	var asnNetwork string
+	if record.ISP.ASN > 0 && record.Network != nil { // The ISP database can also be an ASN database
+		asnNetwork = record.Network.String()
+	}
+	var reverseName string
+	if s.ReverseName {
+		reverseName = iputil.ReverseName(ip)
+	}
+	family := 6
+	if ip.To4() != nil {
+		family = 4
+	}
+	var timestamp string
+	if s.Timestamp {
+		timestamp = time.Now().UTC().Format(time.RFC3339)
 	}
 	return Response{
-		IP:         ip,
-		IPDecimal:  ipDecimal,
-		Country:    country.Name,
-		CountryISO: country.ISO,
-		City:       city,
-		Hostname:   hostname,
+		IP:                ip,
+		IPDecimal:         ipDecimal,
+		Family:            family,
+		Country:           record.Country.Name,
+		CountryISO:        record.Country.ISO,
+		CountryFlag:       flag,
+		City:              record.City,
+		CountryConfidence: record.Confidence.Country,
+		CityConfidence:    record.Confidence.City,
+		Hostname:          hostname,
+		HostnameVerified:  hostnameVerified,
+		ReverseName:       reverseName,
+		ISP:               record.ISP.Name,
+		ConnectionType:    record.ISP.ConnectionType,
+		MobileCountryCode: record.ISP.MobileCountryCode,
+		MobileNetworkCode: record.ISP.MobileNetworkCode,
+		Network:           network,
+		ASNNetwork:        asnNetwork,
+		IsTorExit:         isTorExit,
+		IsBogon:           isBogon,
+		PossibleProxyIP:   record.HostingProvider, // Clients are rarely hosted, so this is likely a proxy
+		Timestamp:         timestamp,
+		Location:          record.Location,
 	}, nil
 }
 
+// serverName returns the server name sent by the client using SNI, if the request was received over TLS.
+func serverName(r *http.Request) string {
+	if r.TLS == nil {
+		return ""
+	}
+	return r.TLS.ServerName
+}
+
+// forwardConfirmed returns true if hostname resolves to ip, i.e. the reverse lookup of ip is forward-confirmed.
+func (s *Server) forwardConfirmed(hostname string, ip net.IP) bool {
+	ips, err := s.LookupHost(hostname)
+	if err != nil {
+		return false
+	}
+	for _, other := range ips {
+		if other.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// hasNonASCIIDigit returns true if s contains digits other than 0-9, such as full-width digits. These are
+// deliberately rejected as ports.
+func hasNonASCIIDigit(s string) bool {
+	for _, c := range s {
+		if c > unicode.MaxASCII && unicode.IsDigit(c) {
+			return true
+		}
+	}
+	return false
+}
+
+func portFromRequest(r *http.Request) (uint64, error) {
+	// Path must be exactly /<prefix>/<port>, so that e.g. /port/../etc and /port/80/ are rejected
+	elements := strings.Split(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if len(elements) != 2 {
+		return 0, fmt.Errorf("invalid port path: %s", r.URL.Path)
+	}
+	if hasNonASCIIDigit(elements[1]) {
+		return 0, errNonASCIIPort
+	}
+	port, err := strconv.ParseUint(elements[1], 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port: %s", elements[1]) // ParseUint returns the maximum value when out of range
+	}
+	if port < 1 || port > 65535 {
+		return port, fmt.Errorf("invalid port: %d", port)
+	}
+	return port, nil
+}
+
+func pingAttempts(r *http.Request) int {
+	attempts, err := strconv.Atoi(r.URL.Query().Get("attempts"))
+	if err != nil || attempts < 1 {
+		return 1
+	}
+	if attempts > maxPingAttempts {
+		return maxPingAttempts
+	}
+	return attempts
+}
+
 func (s *Server) newPortResponse(r *http.Request) (PortResponse, error) {
-	lastElement := filepath.Base(r.URL.Path)
-	port, err := strconv.ParseUint(lastElement, 10, 16)
-	if err != nil || port < 1 || port > 65355 {
-		return PortResponse{Port: port}, fmt.Errorf("invalid port: %d", port)
+	port, err := portFromRequest(r)
+	if err != nil {
+		return PortResponse{Port: port}, err
+	}
+	ip, err := portTargetIP(r)
+	if err != nil {
+		return PortResponse{Port: port}, err
 	}
-	ip, err := ipFromRequest(s.IPHeader, r)
+	_, release, err := s.acquireDials(ip, 1)
 	if err != nil {
 		return PortResponse{Port: port}, err
 	}
+	defer release()
 	err = s.LookupPort(ip, port)
 	return PortResponse{
 		IP:        ip,
 		Port:      port,
 		Reachable: err == nil,
+		Error:     dialError(err),
 	}, nil
 }
 
+// dialError returns the reason a port could not be reached, or an empty string if err is nil.
+func dialError(err error) string {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return ""
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "connection refused"
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return "host unreachable"
+	case errors.Is(err, syscall.ENETUNREACH):
+		return "network unreachable"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "unreachable"
+}
+
+func (s *Server) newPingResponse(r *http.Request) (PortResponse, error) {
+	port, err := portFromRequest(r)
+	if err != nil {
+		return PortResponse{Port: port}, err
+	}
+	ip, err := portTargetIP(r)
+	if err != nil {
+		return PortResponse{Port: port}, err
+	}
+	_, release, err := s.acquireDials(ip, 1)
+	if err != nil {
+		return PortResponse{Port: port}, err
+	}
+	defer release()
+	// Stop at the first failed attempt, so that an unreachable port costs at most one dial timeout
+	var total time.Duration
+	reachable := 0
+	for i := 0; i < pingAttempts(r); i++ {
+		start := time.Now()
+		if err = s.LookupPort(ip, port); err != nil {
+			break
+		}
+		total += time.Since(start)
+		reachable++
+	}
+	response := PortResponse{IP: ip, Port: port, Reachable: reachable > 0}
+	if reachable > 0 {
+		response.RTT = float64(total) / float64(reachable) / float64(time.Millisecond)
+	} else {
+		response.Error = dialError(err)
+	}
+	return response, nil
+}
+
+func (s *Server) jsonResponse(response Response) interface{} {
+	var v interface{} = response
+	if s.DecimalString {
+		v = stringDecimalResponse{Response: response, IPDecimal: response.IPDecimal}
+	}
+	if s.NullFields {
+		v = nullResponse{v}
+	}
+	if len(response.Extra) > 0 {
+		v = extraResponse{v: v, extra: response.Extra}
+	}
+	return v
+}
+
+func (s *Server) portResponse(response PortResponse) interface{} {
+	if s.PortString {
+		return stringPortResponse{PortResponse: response, Port: response.Port}
+	}
+	return response
+}
+
 func (s *Server) CLIHandler(w http.ResponseWriter, r *http.Request) *appError {
-	ip, err := ipFromRequest(s.IPHeader, r)
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err)
+	}
+	w.Header().Set("Content-Type", s.textContentType())
+	fmt.Fprintln(w, ip.String())
+	return nil
+}
+
+// CLIRootHandler renders CLITemplate for command-line clients requesting /, or writes the IP address if there is no
+// such template.
+func (s *Server) CLIRootHandler(w http.ResponseWriter, r *http.Request) *appError {
+	if s.CLITemplate == "" {
+		return s.CLIHandler(w, r)
+	}
+	response, err := s.newResponse(r)
 	if err != nil {
+		return responseError(err)
+	}
+	t, err := s.parseCLITemplate()
+	if err != nil {
+		return internalServerError(err)
+	}
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, &templateData{Response: response, Host: r.Host, BaseURL: s.baseURL(r)}); err != nil {
 		return internalServerError(err)
 	}
+	w.Header().Set("Content-Type", s.textContentType())
+	buf.WriteTo(w)
+	return nil
+}
+
+func (s *Server) CLIIPDecimalHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err)
+	}
+	w.Header().Set("Content-Type", s.textContentType())
+	fmt.Fprintln(w, iputil.ToDecimal(ip))
+	return nil
+}
+
+func (s *Server) CLIBogonHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err)
+	}
+	w.Header().Set("Content-Type", s.textContentType())
+	fmt.Fprintln(w, s.Bogon(ip))
+	return nil
+}
+
+func (s *Server) cliIPFamilyHandler(w http.ResponseWriter, r *http.Request, ipv6 bool) *appError {
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err)
+	}
+	if isIPv6 := ip.To4() == nil; isIPv6 != ipv6 {
+		family := "IPv4"
+		if ipv6 {
+			family = "IPv6"
+		}
+		return misdirectedRequest(nil).WithMessage(fmt.Sprintf("Connect using %s to use this endpoint\n", family))
+	}
+	w.Header().Set("Content-Type", s.textContentType())
 	fmt.Fprintln(w, ip.String())
 	return nil
 }
 
+func (s *Server) CLIIP4Handler(w http.ResponseWriter, r *http.Request) *appError {
+	return s.cliIPFamilyHandler(w, r, false)
+}
+
+func (s *Server) CLIIP6Handler(w http.ResponseWriter, r *http.Request) *appError {
+	return s.cliIPFamilyHandler(w, r, true)
+}
+
+// textContentType returns the Content-Type of text responses, ensuring that it declares a charset.
+func (s *Server) textContentType() string {
+	contentType := s.TextContentType
+	if contentType == "" {
+		contentType = textMediaType
+	}
+	if !strings.Contains(strings.ToLower(contentType), "charset=") {
+		contentType += charsetUTF8
+	}
+	return contentType
+}
+
+// writeField writes a single geo field in CLI responses. Unknown values are written as an empty line, or as an empty
+// 204 response if NoContent is set.
+func (s *Server) writeField(w http.ResponseWriter, value string) {
+	w.Header().Set("Content-Type", s.textContentType())
+	if value == "" && s.NoContent {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	fmt.Fprintln(w, value)
+}
+
 func (s *Server) CLICountryHandler(w http.ResponseWriter, r *http.Request) *appError {
 	response, err := s.newResponse(r)
 	if err != nil {
-		return internalServerError(err)
+		return responseError(err)
+	}
+	if iso, _ := strconv.ParseBool(r.URL.Query().Get("iso")); iso {
+		s.writeField(w, response.CountryISO)
+	} else {
+		s.writeField(w, response.Country)
 	}
-	fmt.Fprintln(w, response.Country)
 	return nil
 }
 
 func (s *Server) CLICountryISOHandler(w http.ResponseWriter, r *http.Request) *appError {
 	response, err := s.newResponse(r)
 	if err != nil {
-		return internalServerError(err)
+		return responseError(err)
 	}
-	fmt.Fprintln(w, response.CountryISO)
+	s.writeField(w, response.CountryISO)
+	return nil
+}
+
+func (s *Server) CLICountryFlagHandler(w http.ResponseWriter, r *http.Request) *appError {
+	response, err := s.newResponse(r)
+	if err != nil {
+		return responseError(err)
+	}
+	s.writeField(w, countryFlag(response.CountryISO))
 	return nil
 }
 
 func (s *Server) CLICityHandler(w http.ResponseWriter, r *http.Request) *appError {
 	response, err := s.newResponse(r)
 	if err != nil {
-		return internalServerError(err)
+		return responseError(err)
 	}
-	fmt.Fprintln(w, response.City)
+	s.writeField(w, response.City)
 	return nil
 }
 
-func (s *Server) JSONHandler(w http.ResponseWriter, r *http.Request) *appError {
+func (s *Server) jsonHandler(w http.ResponseWriter, r *http.Request, pretty bool) *appError {
 	response, err := s.newResponse(r)
+	if err != nil {
+		return responseError(err).AsJSON()
+	}
+	marshal := s.marshalJSON
+	if pretty {
+		marshal = s.marshalIndentJSON
+	}
+	b, err := marshal(s.jsonResponse(response))
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
+
+func (s *Server) JSONHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return s.jsonHandler(w, r, false)
+}
+
+func (s *Server) JSONPrettyHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return s.jsonHandler(w, r, true)
+}
+
+func (s *Server) RawHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err).AsJSON()
+	}
+	records, err := s.db.Raw(ip)
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	b, err := s.marshalJSON(records)
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
+
+func parseLocation(s string) (database.Location, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 2 {
+		return database.Location{}, fmt.Errorf("invalid location: %q", s)
+	}
+	lat, err := strconv.ParseFloat(strings.TrimSpace(parts[0]), 64)
+	if err != nil || lat < -90 || lat > 90 {
+		return database.Location{}, fmt.Errorf("invalid latitude: %q", parts[0])
+	}
+	lon, err := strconv.ParseFloat(strings.TrimSpace(parts[1]), 64)
+	if err != nil || lon < -180 || lon > 180 {
+		return database.Location{}, fmt.Errorf("invalid longitude: %q", parts[1])
+	}
+	return database.Location{Latitude: lat, Longitude: lon}, nil
+}
+
+func (s *Server) DistanceHandler(w http.ResponseWriter, r *http.Request) *appError {
+	to, err := parseLocation(r.URL.Query().Get("to"))
+	if err != nil {
+		return badRequest(err).WithMessage("Invalid location, expected ?to=latitude,longitude").AsJSON()
+	}
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err).AsJSON()
+	}
+	record, err := s.lookup(ip)
 	if err != nil {
 		return internalServerError(err).AsJSON()
 	}
-	b, err := json.Marshal(response)
+	location := record.Location
+	if location.IsZero() {
+		return badRequest(nil).WithMessage(fmt.Sprintf("Location of %s is unknown", ip)).AsJSON()
+	}
+	response := DistanceResponse{
+		IP:        ip,
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+		Distance:  math.Round(location.DistanceTo(to)*100) / 100,
+	}
+	b, err := s.marshalJSON(response)
 	if err != nil {
 		return internalServerError(err).AsJSON()
 	}
-	w.Header().Set("Content-Type", jsonMediaType)
-	w.Write(b)
+	s.writeJSON(w, b)
 	return nil
 }
 
 func (s *Server) PortHandler(w http.ResponseWriter, r *http.Request) *appError {
 	response, err := s.newPortResponse(r)
 	if err != nil {
-		return badRequest(err).WithMessage(fmt.Sprintf("Invalid port: %d", response.Port)).AsJSON()
+		return portError(err, response.Port)
 	}
-	b, err := json.Marshal(response)
+	b, err := s.marshalJSON(s.portResponse(response))
 	if err != nil {
 		return internalServerError(err).AsJSON()
 	}
-	w.Header().Set("Content-Type", jsonMediaType)
-	w.Write(b)
+	s.writeJSON(w, b)
+	return nil
+}
+
+func portError(err error, port uint64) *appError {
+	if errors.Is(err, errInvalidIP) || err == errTooManyDials {
+		return responseError(err).AsJSON()
+	}
+	if err == errNonASCIIPort {
+		return badRequest(err).WithMessage("Invalid port: only digits 0-9 are allowed").AsJSON()
+	}
+	return badRequest(err).WithMessage(fmt.Sprintf("Invalid port: %d", port)).AsJSON()
+}
+
+func (s *Server) PingHandler(w http.ResponseWriter, r *http.Request) *appError {
+	response, err := s.newPingResponse(r)
+	if err != nil {
+		return portError(err, response.Port)
+	}
+	b, err := s.marshalJSON(s.portResponse(response))
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
+
+func validHostname(name string) bool {
+	name = strings.TrimSuffix(name, ".")
+	if name == "" || len(name) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-' || c == '_') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (s *Server) CLIDecimalHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n := strings.TrimPrefix(r.URL.Path, "/decimal/")
+	ip, err := iputil.FromDecimal(n)
+	if err != nil {
+		return badRequest(err).WithMessage(fmt.Sprintf("Invalid decimal IP: %s\n", err))
+	}
+	w.Header().Set("Content-Type", s.textContentType())
+	fmt.Fprintln(w, ip.String())
+	return nil
+}
+
+func (s *Server) ResolveHandler(w http.ResponseWriter, r *http.Request) *appError {
+	hostname := strings.TrimPrefix(r.URL.Path, "/resolve/")
+	if !validHostname(hostname) {
+		return badRequest(nil).WithMessage(fmt.Sprintf("Invalid hostname: %s", hostname)).AsJSON()
+	}
+	ips, err := s.LookupHost(hostname)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return notFound(err).WithMessage(fmt.Sprintf("No such host: %s", hostname)).AsJSON()
+		}
+		return serviceUnavailable(err).AsJSON()
+	}
+	b, err := s.marshalJSON(ResolveResponse{Hostname: hostname, IPs: ips})
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
+
+func (s *Server) parseTemplate(path string) (*template.Template, error) {
+	if s.DevMode {
+		return template.ParseFiles(path)
+	}
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+	if t, ok := s.templates[path]; ok {
+		return t, nil
+	}
+	t, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, err
+	}
+	if s.templates == nil {
+		s.templates = make(map[string]*template.Template)
+	}
+	s.templates[path] = t
+	return t, nil
+}
+
+func (s *Server) parseCLITemplate() (*texttemplate.Template, error) {
+	if s.DevMode {
+		return texttemplate.ParseFiles(s.CLITemplate)
+	}
+	s.templateMu.Lock()
+	defer s.templateMu.Unlock()
+	if s.cliTemplate != nil {
+		return s.cliTemplate, nil
+	}
+	t, err := texttemplate.ParseFiles(s.CLITemplate)
+	if err != nil {
+		return nil, err
+	}
+	s.cliTemplate = t
+	return t, nil
+}
+
+func (s *Server) templateFor(host string) string {
+	if path, ok := s.HostTemplates[host]; ok {
+		return path
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		if path, ok := s.HostTemplates[h]; ok {
+			return path
+		}
+	}
+	return s.Template
+}
+
+// mapData holds the location and zoom level to use when showing the client on a map, and the coordinates of the
+// map tile containing the location, using the tile numbering of OpenStreetMap.
+type mapData struct {
+	Latitude  float64
+	Longitude float64
+	Zoom      int
+	TileX     int
+	TileY     int
+}
+
+func newMapData(location database.Location, city string) *mapData {
+	if location.IsZero() {
+		return nil
+	}
+	zoom := 5 // Roughly the size of a country
+	if city != "" {
+		zoom = 11
+	}
+	n := math.Exp2(float64(zoom))
+	lat := location.Latitude * math.Pi / 180
+	return &mapData{
+		Latitude:  location.Latitude,
+		Longitude: location.Longitude,
+		Zoom:      zoom,
+		TileX:     int((location.Longitude + 180) / 360 * n),
+		TileY:     int((1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n),
+	}
+}
+
+// templateData is the data available to templates. BaseURL is the scheme and host of the request, for building
+// absolute URLs.
+type templateData struct {
+	Response
+	Host    string
+	BaseURL string
+	JSON    string
+	Port    bool
+	Map     *mapData
+}
+
+// CheckTemplates renders Template, HostTemplates, CLITemplate and ErrorTemplate with placeholder data, returning an
+// error if any of them cannot be parsed or references fields that do not exist.
+func (s *Server) CheckTemplates() error {
+	paths := []string{s.Template}
+	for _, path := range s.HostTemplates {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	data := templateData{Map: &mapData{}} // Map is set so that templates can access its fields
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		t, err := s.parseTemplate(path)
+		if err != nil {
+			return err
+		}
+		if err := t.Execute(ioutil.Discard, &data); err != nil {
+			return err
+		}
+	}
+	if s.CLITemplate != "" {
+		t, err := s.parseCLITemplate()
+		if err != nil {
+			return err
+		}
+		if err := t.Execute(ioutil.Discard, &data); err != nil {
+			return err
+		}
+	}
+	if s.ErrorTemplate != "" {
+		t, err := s.parseTemplate(s.ErrorTemplate)
+		if err != nil {
+			return err
+		}
+		if err := t.Execute(ioutil.Discard, &errorTemplateData{}); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
 func (s *Server) DefaultHandler(w http.ResponseWriter, r *http.Request) *appError {
 	response, err := s.newResponse(r)
 	if err != nil {
-		return internalServerError(err)
+		return responseError(err)
 	}
-	t, err := template.ParseFiles(s.Template)
+	t, err := s.parseTemplate(s.templateFor(r.Host))
 	if err != nil {
 		return internalServerError(err)
 	}
-	json, err := json.MarshalIndent(response, "", "  ")
+	json, err := s.marshalIndentJSON(s.jsonResponse(response))
 	if err != nil {
 		return internalServerError(err)
 	}
-	var data = struct {
-		Response
-		Host string
-		JSON string
-		Port bool
-	}{
-		response,
-		r.Host,
-		string(json),
-		s.LookupPort != nil,
-	}
-	if err := t.Execute(w, &data); err != nil {
+	// Placeholder is only used for display, the JSON output above keeps the country empty
+	if response.Country == "" && s.UnknownCountry != "" && s.hasGeo() {
+		response.Country = s.UnknownCountry
+	}
+	data := templateData{
+		Response: response,
+		Host:     r.Host,
+		BaseURL:  s.baseURL(r),
+		JSON:     string(json),
+		Port:     s.LookupPort != nil,
+		Map:      newMapData(response.Location, response.City),
+	}
+	// Render to a buffer first, so that a failing template results in an error instead of a truncated page
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, &data); err != nil {
 		return internalServerError(err)
 	}
+	w.Header().Set("Content-Type", htmlMediaType+charsetUTF8)
+	w.Write(buf.Bytes())
 	return nil
 }
 
+func (s *Server) HealthHandler(w http.ResponseWriter, r *http.Request) *appError {
+	fmt.Fprintln(w, "ok")
+	return nil
+}
+
+// portPaths are the paths of port testing routes.
+var portPaths = []string{"/port/", "/ping/", "/ports"}
+
+func isPortPath(path string) bool {
+	for _, p := range portPaths {
+		if p == path {
+			return true
+		}
+	}
+	return false
+}
+
+func portTestingDisabledHandler(w http.ResponseWriter, r *http.Request) *appError {
+	return notImplemented(nil).WithMessage("port testing disabled").AsJSON()
+}
+
 func NotFoundHandler(w http.ResponseWriter, r *http.Request) *appError {
 	err := notFound(nil).WithMessage("404 page not found")
 	if r.Header.Get("accept") == jsonMediaType {
@@ -214,6 +1241,100 @@ func cliMatcher(r *http.Request) bool {
 	return false
 }
 
+// browserMatcher returns whether r clearly comes from a browser: the user agent is Mozilla compatible, as claimed by all
+// major browsers, and HTML is accepted.
+func browserMatcher(r *http.Request) bool {
+	ua := useragent.Parse(r.UserAgent())
+	return ua.Product == "Mozilla" && strings.Contains(r.Header.Get("Accept"), htmlMediaType)
+}
+
+func (s *Server) allowedHost(host string) bool {
+	if len(s.AllowedHosts) == 0 {
+		return true
+	}
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, h := range s.AllowedHosts {
+		if strings.EqualFold(h, host) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) allowedHostHandler(next http.Handler) http.Handler {
+	return appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		if !s.allowedHost(r.Host) {
+			err := misdirectedRequest(fmt.Errorf("host not allowed: %s", r.Host)).WithMessage("421 misdirected request")
+			if r.Header.Get("accept") == jsonMediaType {
+				err = err.AsJSON()
+			}
+			return err
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+func (s *Server) requireUserAgentHandler(next http.Handler) http.Handler {
+	return appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		if strings.TrimSpace(r.UserAgent()) == "" {
+			err := badRequest(errors.New("missing user agent")).WithMessage("400 bad request")
+			if r.Header.Get("accept") == jsonMediaType {
+				err = err.AsJSON()
+			}
+			return err
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+// redirectHTTPSHandler permanently redirects browsers making plain HTTP requests to the same URL using HTTPS. The
+// scheme and host are those seen by the client, as determined by baseURL. Other clients are answered over HTTP, so
+// that scripts keep working.
+func (s *Server) redirectHTTPSHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		base := s.baseURL(r)
+		if !strings.HasPrefix(base, "http://") || (r.Method != "GET" && r.Method != "HEAD") || !browserMatcher(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		http.Redirect(w, r, "https://"+strings.TrimPrefix(base, "http://")+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
+
+// ipResponseHeader sets the IP of the client in the X-Your-IP header of all responses.
+func (s *Server) ipResponseHeader(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if ip, err := s.clientIP(r); err == nil {
+			w.Header().Set("X-Your-IP", ip.String())
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func securityHeaders(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Strict-Transport-Security", "max-age=31536000")
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Security-Policy", contentSecurityPolicy)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// altSvcHandler advertises HTTP/3 on HTTP3Port to clients connecting over TLS.
+func (s *Server) altSvcHandler(next http.Handler) http.Handler {
+	altSvc := fmt.Sprintf(`h3=":%d"; ma=86400`, s.HTTP3Port)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.TLS != nil {
+			w.Header().Set("Alt-Svc", altSvc)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 type appHandler func(http.ResponseWriter, *http.Request) *appError
 
 func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
@@ -229,43 +1350,364 @@ func (fn appHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 			}
 			e.Message = string(b)
 		}
-		// Set Content-Type of response if set in error
+		for k, v := range e.Header {
+			w.Header()[k] = v
+		}
+		// Set Content-Type of response if set in error, otherwise the error is plain text
 		if e.ContentType != "" {
-			w.Header().Set("Content-Type", e.ContentType)
+			w.Header().Set("Content-Type", e.ContentType+charsetUTF8)
+		} else {
+			w.Header().Set("Content-Type", textMediaType+charsetUTF8)
 		}
 		w.WriteHeader(e.Code)
 		fmt.Fprint(w, e.Message)
 	}
 }
 
+type errorTemplateData struct {
+	Code    int
+	Status  string
+	Message string
+}
+
+// errorPageHandler renders errors returned by next using ErrorTemplate, for clients accepting HTML. The plain text error
+// is kept if the template cannot be rendered.
+func (s *Server) errorPageHandler(next appHandler) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		e := next(w, r)
+		if e == nil || e.IsJSON() || !strings.Contains(r.Header.Get("Accept"), htmlMediaType) {
+			return e
+		}
+		t, err := s.parseTemplate(s.ErrorTemplate)
+		if err != nil {
+			return e
+		}
+		data := errorTemplateData{e.Code, http.StatusText(e.Code), strings.TrimSpace(e.Message)}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, &data); err != nil {
+			return e
+		}
+		e.ContentType = htmlMediaType
+		e.Message = buf.String()
+		return e
+	}
+}
+
+func (s *Server) apiKeyHeader() string {
+	if s.APIKeyHeader == "" {
+		return defaultAPIKeyHeader
+	}
+	return s.APIKeyHeader
+}
+
+// requireAPIKey restricts next to clients presenting one of APIKeys, in the APIKeyHeader header or the api_key query
+// parameter. All clients are allowed if APIKeys is empty.
+func (s *Server) requireAPIKey(next appHandler) appHandler {
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		if len(s.APIKeys) == 0 {
+			return next(w, r)
+		}
+		key := r.Header.Get(s.apiKeyHeader())
+		if key == "" {
+			key = r.URL.Query().Get("api_key")
+		}
+		for _, k := range s.APIKeys {
+			if subtle.ConstantTimeCompare([]byte(key), []byte(k)) == 1 {
+				return next(w, r)
+			}
+		}
+		err := unauthorized(nil)
+		if r.Header.Get("accept") == jsonMediaType {
+			err = err.AsJSON()
+		}
+		return err
+	}
+}
+
+func (s *Server) maxPathLengthHandler(next http.Handler) http.Handler {
+	return appHandler(func(w http.ResponseWriter, r *http.Request) *appError {
+		if len(r.URL.Path) > s.MaxPathLength {
+			err := badRequest(nil).WithMessage("400 bad request")
+			if r.Header.Get("accept") == jsonMediaType {
+				err = err.AsJSON()
+			}
+			return err
+		}
+		next.ServeHTTP(w, r)
+		return nil
+	})
+}
+
+// streamingPaths are the paths whose responses are written while they are produced.
+var streamingPaths = map[string]bool{"/events": true, "/speed": true, "/batch.csv": true}
+
+// timeoutHandler enforces RequestTimeout. http.TimeoutHandler buffers responses and hides http.Flusher, so streaming
+// responses instead get a deadline on their context, which they stop writing at.
+func (s *Server) timeoutHandler(next http.Handler) http.Handler {
+	buffered := http.TimeoutHandler(next, s.RequestTimeout, serviceUnavailable(nil).Message)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !streamingPaths[r.URL.Path] {
+			buffered.ServeHTTP(w, r)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), s.RequestTimeout)
+		defer cancel()
+		next.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// trustedPeer returns whether the peer sending request r is a trusted proxy. No peer is trusted if TrustedProxy is nil.
+func (s *Server) trustedPeer(r *http.Request) bool {
+	if s.TrustedProxy == nil {
+		return false
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	ip := net.ParseIP(host)
+	return err == nil && ip != nil && s.TrustedProxy(ip)
+}
+
+// trustedProxyHandler removes client IP, port and URL headers from requests not sent by a trusted proxy.
+func (s *Server) trustedProxyHandler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.trustedPeer(r) {
+			headers := []string{s.IPHeader, s.PortHeader}
+			if s.ForwardedURL {
+				headers = append(headers, forwardedURLHeaders...)
+			}
+			for _, h := range headers {
+				if h != "" {
+					r.Header.Del(h)
+				}
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) Handler() http.Handler {
+	if s.MaxLookups > 0 {
+		s.lookups = make(chan struct{}, s.MaxLookups)
+	}
+	if s.MaxStreams > 0 {
+		s.streams = make(chan struct{}, s.MaxStreams)
+	}
+	if s.MaxDials > 0 || s.MaxClientDials > 0 {
+		s.dials = newDialLimiter(s.MaxDials, s.MaxClientDials)
+	}
 	r := NewRouter()
 
+	// Root, in order of precedence. Browsers always get the HTML page, whatever else their request matches
+	browser := r.Route("GET", "/", s.DefaultHandler)
+	browser.MatcherFunc(browserMatcher)
+	browser.condition = "Browser accepting HTML"
+	rootOrder := s.RootOrder
+	if len(rootOrder) == 0 {
+		rootOrder = defaultRootOrder
+	}
+	for _, name := range rootOrder {
+		switch name {
+		case RootJSON:
+			r.Route("GET", "/", s.JSONHandler).Header("Accept", jsonMediaType)
+		case RootCLI:
+			route := r.Route("GET", "/", s.CLIRootHandler)
+			route.MatcherFunc(cliMatcher)
+			route.condition = "User-Agent of command-line client"
+		case RootText:
+			r.Route("GET", "/", s.CLIRootHandler).Header("Accept", textMediaType)
+		}
+	}
+
 	// JSON
-	r.Route("GET", "/", s.JSONHandler).Header("Accept", jsonMediaType)
 	r.Route("GET", "/json", s.JSONHandler)
+	r.Route("GET", "/json/pretty", s.JSONPrettyHandler)
+	r.Route("GET", "/whoami", s.WhoamiHandler)
+	r.Route("GET", "/info", s.InfoHandler)
+	r.Route("GET", "/formats", s.FormatsHandler)
+	if s.ServerHostname != "" {
+		r.Route("GET", "/server", s.ServerHandler)
+	}
+	if s.EventInterval > 0 {
+		r.Route("GET", "/events", s.EventsHandler)
+	}
 
 	// CLI
-	r.Route("GET", "/", s.CLIHandler).MatcherFunc(cliMatcher)
-	r.Route("GET", "/", s.CLIHandler).Header("Accept", textMediaType)
 	r.Route("GET", "/ip", s.CLIHandler)
-	if !s.db.IsEmpty() {
+	r.Route("GET", "/ip4", s.CLIIP4Handler)
+	r.Route("GET", "/ip6", s.CLIIP6Handler)
+	r.Route("GET", "/ip-decimal", s.CLIIPDecimalHandler)
+	r.RoutePrefix("GET", "/decimal/", s.CLIDecimalHandler)
+	r.Route("GET", "/all", s.CLIAllHandler)
+	if s.Bogon != nil {
+		r.Route("GET", "/bogon", s.CLIBogonHandler)
+	}
+	if s.hasGeo() {
 		r.Route("GET", "/country", s.CLICountryHandler)
 		r.Route("GET", "/country-iso", s.CLICountryISOHandler)
+		r.Route("GET", "/country-flag", s.CLICountryFlagHandler)
 		r.Route("GET", "/city", s.CLICityHandler)
+		r.Route("GET", "/distance", s.DistanceHandler)
+		if s.RawLookup {
+			r.Route("GET", "/raw", s.requireAPIKey(s.RawHandler))
+		}
+		if s.Batch {
+			r.Route("POST", "/batch.csv", s.requireAPIKey(s.BatchCSVHandler))
+		}
+	}
+
+	// Lookup of any IP
+	if s.IPLookup {
+		ipAll := r.RoutePrefix("GET", "/", s.IPAllHandler)
+		ipAll.MatcherFunc(func(req *http.Request) bool {
+			_, ok := ipAllPath(req.URL.Path)
+			return ok
+		})
+		ipAll.condition = "Path is /IP/all"
 	}
 
-	// Browser
+	// Browser, used when no other root handler matches
 	r.Route("GET", "/", s.DefaultHandler)
 
 	// Port testing
 	if s.LookupPort != nil {
 		r.RoutePrefix("GET", "/port/", s.PortHandler)
+		r.RoutePrefix("GET", "/ping/", s.PingHandler)
+		r.Route("GET", "/ports", s.PortsHandler)
+	} else {
+		// Registered so that clients can tell that the feature is disabled from a path not existing
+		for _, path := range portPaths {
+			if strings.HasSuffix(path, "/") {
+				r.RoutePrefix("GET", path, portTestingDisabledHandler)
+			} else {
+				r.Route("GET", path, portTestingDisabledHandler)
+			}
+		}
+	}
+
+	// Forward lookup
+	if s.Resolve && s.LookupHost != nil {
+		handler := s.requireAPIKey(s.ResolveHandler)
+		if s.ResolveRateLimit > 0 {
+			// Each request makes us query DNS, so it's limited separately from cheaper requests
+			limiter := newRateLimiter(s.ResolveRateLimit, s.ResolveRateLimit)
+			handler = s.rateLimited(handler, limiter, s.ResolveRateLimit)
+		}
+		r.RoutePrefix("GET", "/resolve/", handler)
+	}
+
+	// Speed test
+	if s.Speed {
+		r.Route("GET", "/speed", s.SpeedHandler)
+		r.Route("POST", "/speed/upload", s.UploadHandler)
+	}
+
+	if s.OpenAPI {
+		r.Route("GET", "/openapi.json", s.OpenAPIHandler)
+	}
+
+	r.Disable(s.DisabledRoutes...)
+	s.routesMu.Lock()
+	s.routes = r.routes
+	s.routesMu.Unlock()
+
+	handler := r.Handler()
+	if s.ErrorTemplate != "" {
+		handler = s.errorPageHandler(r.serve)
+	}
+	if s.RequestTimeout > 0 {
+		handler = s.timeoutHandler(handler)
+	}
+	if s.MaxPathLength > 0 {
+		handler = s.maxPathLengthHandler(handler)
+	}
+	if s.RateLimiter != nil {
+		handler = s.rateLimitHandler(handler, s.RateLimiter)
+	} else if s.RateLimit > 0 {
+		handler = s.rateLimitHandler(handler, newRateLimiter(s.RateLimit, s.RateLimitBurst))
+	}
+	if len(s.AllowedHosts) > 0 {
+		handler = s.allowedHostHandler(handler)
+	}
+	if s.RequireUserAgent {
+		handler = s.requireUserAgentHandler(handler)
+	}
+	if s.RedirectHTTPS {
+		handler = s.redirectHTTPSHandler(handler)
+	}
+	if s.Gzip {
+		handler = gzipHandler(handler, s.MinCompressSize)
 	}
+	if s.SecurityHeaders {
+		handler = securityHeaders(handler)
+	}
+	if s.HTTP3Port > 0 {
+		handler = s.altSvcHandler(handler)
+	}
+	if s.IPResponseHeader {
+		handler = s.ipResponseHeader(handler)
+	}
+	if s.AccessLog != nil {
+		l := &accessLog{
+			w:         s.AccessLog,
+			format:    s.AccessLogFormat,
+			ipHeader:  s.IPHeader,
+			hops:      s.TrustedHops,
+			anonymize: s.AnonymizeLog,
+			now:       time.Now,
+		}
+		handler = l.handler(handler)
+	}
+	if s.TrustedProxy != nil {
+		handler = s.trustedProxyHandler(handler)
+	}
+	return handler
+}
 
+func (s *Server) AdminHandler() http.Handler {
+	r := NewRouter()
+	r.Route("GET", "/health", s.HealthHandler)
+	r.Route("GET", "/debug/routes", s.DebugRoutesHandler)
 	return r.Handler()
 }
 
-func (s *Server) ListenAndServe(addr string) error {
-	return http.ListenAndServe(addr, s.Handler())
+// ListenAndServe listens on Addr and serves requests, like http.Server. An address can also be passed to listen on
+// instead of Addr. If neither is set, ":http" is used.
+func (s *Server) ListenAndServe(addr ...string) error {
+	if len(addr) > 1 {
+		return fmt.Errorf("expected at most one address, got %d", len(addr))
+	}
+	address := s.Addr
+	if len(addr) == 1 && addr[0] != "" {
+		address = addr[0]
+	}
+	if address == "" {
+		address = ":http"
+	}
+	l, err := net.Listen("tcp", address)
+	if err != nil {
+		return err
+	}
+	return s.Serve(l)
+}
+
+// serveHandler returns the handler shared by all listeners, so that limits such as MaxLookups apply across them.
+func (s *Server) serveHandler() http.Handler {
+	s.handlerOnce.Do(func() { s.handler = s.Handler() })
+	return s.handler
+}
+
+// connContextKey is the context key of the connection a request was received on.
+type connContextKey struct{}
+
+func (s *Server) Serve(l net.Listener) error {
+	srv := &http.Server{
+		Handler: s.serveHandler(),
+		ConnContext: func(ctx context.Context, c net.Conn) context.Context {
+			return context.WithValue(ctx, connContextKey{}, c)
+		},
+	}
+	return srv.Serve(l)
+}
+
+func (s *Server) ServeAdmin(addr string) error {
+	return http.ListenAndServe(addr, s.AdminHandler())
 }
@@ -0,0 +1,12 @@
+//go:build http3
+
+package http
+
+import "github.com/quic-go/quic-go/http3"
+
+// ListenAndServeQUIC serves HTTP/3 on the UDP address addr, using the certificate and private key in the files cert
+// and key. Requests are served by the same handler as Serve and ListenAndServe.
+func (s *Server) ListenAndServeQUIC(addr, cert, key string) error {
+	srv := &http3.Server{Addr: addr, Handler: s.serveHandler()}
+	return srv.ListenAndServeTLS(cert, key)
+}
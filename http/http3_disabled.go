@@ -0,0 +1,10 @@
+//go:build !http3
+
+package http
+
+import "errors"
+
+// ListenAndServeQUIC always fails, as HTTP/3 support is only included when building with the http3 tag.
+func (s *Server) ListenAndServeQUIC(addr, cert, key string) error {
+	return errors.New("HTTP/3 is not supported by this build, rebuild with -tags http3")
+}
@@ -1,27 +1,124 @@
 package http
 
 import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
 	"testing"
+	"time"
 
 	"github.com/mpolden/ipd/iputil/database"
 )
 
-func lookupAddr(net.IP) (string, error) { return "localhost", nil }
-func lookupPort(net.IP, uint64) error   { return nil }
+func lookupAddr(context.Context, net.IP) (string, error) { return "localhost", nil }
+func lookupPort(net.IP, uint64) error                    { return nil }
 
 type testDb struct{}
 
+// lookup implements Lookup for test databases in terms of their other methods
+func lookup(db database.Client, ip net.IP) (database.Record, error) {
+	country, _ := db.Country(ip)
+	city, _ := db.City(ip)
+	isp, _ := db.ISP(ip)
+	location, _ := db.Location(ip)
+	confidence, _ := db.Confidence(ip)
+	return database.Record{Country: country, City: city, ISP: isp, Location: location, Confidence: confidence}, nil
+}
+
+type emptyCountryDb struct{ testDb }
+
+func (t *emptyCountryDb) Country(net.IP) (database.Country, error)   { return database.Country{}, nil }
+func (t *emptyCountryDb) Location(net.IP) (database.Location, error) { return database.Location{}, nil }
+func (t *emptyCountryDb) Lookup(ip net.IP) (database.Record, error)  { return lookup(t, ip) }
+
+type enterpriseDb struct{ testDb }
+
+func (t *enterpriseDb) Confidence(net.IP) (database.Confidence, error) {
+	return database.Confidence{Country: 99, City: 80}, nil
+}
+
+func (t *enterpriseDb) Lookup(ip net.IP) (database.Record, error) { return lookup(t, ip) }
+
+type localizedDb struct{ testDb }
+
+func (t *localizedDb) Lookup(ip net.IP) (database.Record, error) {
+	record, _ := lookup(t, ip)
+	record.CountryNames = map[string]string{"en": "Elbonia", "de": "Elbonien", "pt-BR": "Elbônia"}
+	record.CityNames = map[string]string{"en": "Bornyasherk", "de": "Bornjascherk"}
+	return record, nil
+}
+
+type hostingDb struct{ testDb }
+
+func (t *hostingDb) Lookup(ip net.IP) (database.Record, error) {
+	record, _ := lookup(t, ip)
+	hosting := ip.IsLoopback()
+	record.HostingProvider = &hosting
+	return record, nil
+}
+
+type networkDb struct{ testDb }
+
+func (t *networkDb) Lookup(ip net.IP) (database.Record, error) {
+	record, _ := lookup(t, ip)
+	_, record.Network, _ = net.ParseCIDR("192.0.2.0/28")
+	return record, nil
+}
+
+type mobileDb struct{ testDb }
+
+func (t *mobileDb) Lookup(ip net.IP) (database.Record, error) { return lookup(t, ip) }
+
+func (t *mobileDb) ISP(net.IP) (database.ISP, error) {
+	return database.ISP{Name: "Elbonia Mobile", ConnectionType: "Cellular", MobileCountryCode: "310",
+		MobileNetworkCode: "004"}, nil
+}
+
 func (t *testDb) Country(net.IP) (database.Country, error) {
 	return database.Country{Name: "Elbonia", ISO: "EB"}, nil
 }
 
 func (t *testDb) City(net.IP) (string, error) { return "Bornyasherk", nil }
-func (t *testDb) IsEmpty() bool               { return false }
+
+func (t *testDb) Location(net.IP) (database.Location, error) {
+	return database.Location{Latitude: 59.9139, Longitude: 10.7522}, nil
+}
+
+func (t *testDb) ISP(net.IP) (database.ISP, error) {
+	return database.ISP{ASN: 64496, Name: "Elbonia Telecom", ConnectionType: "Cable/DSL"}, nil
+}
+
+func (t *testDb) Raw(net.IP) (map[string]interface{}, error) {
+	return map[string]interface{}{"city": map[string]interface{}{"names": map[string]string{"en": "Bornyasherk"}}}, nil
+}
+
+func (t *testDb) Confidence(net.IP) (database.Confidence, error) { return database.Confidence{}, nil }
+
+func (t *testDb) Lookup(ip net.IP) (database.Record, error) { return lookup(t, ip) }
+
+func (t *testDb) Types() map[string]string { return map[string]string{"city": "GeoLite2-City"} }
+
+func (t *testDb) IsEmpty() bool { return false }
 
 func testServer() *Server {
 	return &Server{db: &testDb{}, LookupAddr: lookupAddr, LookupPort: lookupPort}
@@ -62,8 +159,18 @@ func TestCLIHandlers(t *testing.T) {
 		{s.URL, "127.0.0.1\n", 200, "curl/7.43.0", ""},
 		{s.URL, "127.0.0.1\n", 200, "foo/bar", textMediaType},
 		{s.URL + "/ip", "127.0.0.1\n", 200, "", ""},
+		{s.URL + "/ip4", "127.0.0.1\n", 200, "", ""},
+		{s.URL + "/ip6", "Connect using IPv6 to use this endpoint\n", 421, "", ""},
+		{s.URL + "/ip-decimal", "2130706433\n", 200, "", ""},
+		{s.URL + "/decimal/2130706433", "127.0.0.1\n", 200, "", ""},
+		{s.URL + "/decimal/0x7f000001", "127.0.0.1\n", 200, "", ""},
+		{s.URL + "/decimal/0o17700000001", "127.0.0.1\n", 200, "", ""},
+		{s.URL + "/decimal/017700000001", "Invalid decimal IP: ambiguous number: 017700000001: use 0o prefix for octal\n", 400, "", ""},
 		{s.URL + "/country", "Elbonia\n", 200, "", ""},
 		{s.URL + "/country-iso", "EB\n", 200, "", ""},
+		{s.URL + "/country?iso=1", "EB\n", 200, "", ""},
+		{s.URL + "/country-flag", "\U0001F1EA\U0001F1E7\n", 200, "", ""},
+		{s.URL + "/country?iso=false", "Elbonia\n", 200, "", ""},
 		{s.URL + "/city", "Bornyasherk\n", 200, "", ""},
 		{s.URL + "/foo", "404 page not found", 404, "", ""},
 	}
@@ -82,97 +189,3104 @@ func TestCLIHandlers(t *testing.T) {
 	}
 }
 
-func TestDisabledHandlers(t *testing.T) {
+func TestCLIAllHandler(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		fields []string
+		out    string
+	}{
+		{nil, "ip: 127.0.0.1\nip_decimal: 2130706433\nfamily: 4\ncountry: Elbonia\ncountry_iso: EB\ncity: Bornyasherk\n" +
+			"hostname: localhost\nisp: Elbonia Telecom\nconnection_type: Cable/DSL\n"},
+		{[]string{"city", "ip", "country_flag"}, "city: Bornyasherk\nip: 127.0.0.1\n"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.AllFields = tt.fields
+		r := httptest.NewRequest("GET", "/all", nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for fields %v, got %q", tt.out, tt.fields, got)
+		}
+	}
+	if err := ValidateFields([]string{"ip", "city"}); err != nil {
+		t.Error(err)
+	}
+	if err := ValidateFields([]string{"ip", "foo"}); err == nil {
+		t.Error("Expected error for invalid field")
+	}
+	index := responseFieldIndex()
+	if len(index) != len(responseFields()) {
+		t.Errorf("Expected %d fields in index, got %d", len(responseFields()), len(index))
+	}
+	for name, i := range index {
+		if tag := reflect.TypeOf(Response{}).Field(i).Tag.Get("json"); strings.Split(tag, ",")[0] != name {
+			t.Errorf("Expected field %d to be %s, got tag %q", i, name, tag)
+		}
+	}
+}
+
+func TestIPAllHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		enabled bool
+		url     string
+		status  int
+		out     string
+	}{
+		{false, "/192.0.2.1/all", 404, "404 page not found"},
+		{true, "/192.0.2.1/all", 200, "ip: 192.0.2.1\nip_decimal: 3221225985\nfamily: 4\ncountry: Elbonia\ncountry_iso: EB\n" +
+			"city: Bornyasherk\nhostname: localhost\nisp: Elbonia Telecom\nconnection_type: Cable/DSL\n"},
+		{true, "/2001:db8::1/all", 200, "ip: 2001:db8::1\n"},
+		{true, "/foo/all", 404, "404 page not found"},
+		{true, "/192.0.2.1", 404, "404 page not found"},
+		{true, "/all", 200, "ip: 127.0.0.1\n"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.IPLookup = tt.enabled
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, w.Code)
+		}
+		if got := w.Body.String(); !strings.HasPrefix(got, tt.out) {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, got)
+		}
+	}
+	// Paths not matching the lookup route are not affected by it
 	server := testServer()
-	server.LookupPort = nil
-	server.LookupAddr = nil
-	server.db, _ = database.New("", "")
+	server.IPLookup = true
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("POST", "/foo", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected 404 for POST /foo, got %d", w.Code)
+	}
+}
+
+func TestFamily(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		remoteAddr string
+		out        int
+	}{
+		{"127.0.0.1:1337", 4},
+		{"[::ffff:127.0.0.1]:1337", 4},
+		{"[::1]:1337", 6},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		testServer().Handler().ServeHTTP(w, r)
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Family != tt.out {
+			t.Errorf("Expected family %d for %s, got %d", tt.out, tt.remoteAddr, response.Family)
+		}
+	}
+}
+
+func TestRequestTimeout(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		timeout time.Duration
+		status  int
+	}{
+		{0, 200},
+		{time.Second, 200},
+		{10 * time.Millisecond, 503},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.RequestTimeout = tt.timeout
+		server.LookupAddr = func(context.Context, net.IP) (string, error) {
+			time.Sleep(50 * time.Millisecond)
+			return "localhost", nil
+		}
+		r := httptest.NewRequest("GET", "/json", nil)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for timeout %s, got %d", tt.status, tt.timeout, w.Code)
+		}
+	}
+}
+
+func TestRequestTimeoutStreaming(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.RequestTimeout = 200 * time.Millisecond
+	server.EventInterval = 10 * time.Millisecond
+	server.Speed = true
 	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 200 {
+		t.Fatalf("Expected 200, got %d", res.StatusCode)
+	}
+	scanner := bufio.NewScanner(res.Body)
+	events := 0
+	for scanner.Scan() { // Stream ends at the deadline
+		if scanner.Text() == "data: 127.0.0.1" {
+			events++
+		}
+	}
+	if events < 2 {
+		t.Errorf("Expected events to be streamed before deadline, got %d", events)
+	}
+
+	res, err = http.Get(s.URL + "/speed?bytes=1024")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	b, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.StatusCode != 200 || len(b) != 1024 {
+		t.Errorf("Expected 200 with 1024 bytes, got %d with %d bytes", res.StatusCode, len(b))
+	}
+}
+
+func TestListenAndServe(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	used := l.Addr().String()
+	defer l.Close()
+	var tests = []struct {
+		addr     string
+		args     []string
+		contains string
+	}{
+		{used, nil, used},                      // Addr
+		{"127.0.0.1:-1", []string{used}, used}, // Explicit address replaces Addr
+		{used, []string{""}, used},             // Empty address falls back to Addr
+		{"", []string{"a", "b"}, "expected at most one address"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.Addr = tt.addr
+		err := server.ListenAndServe(tt.args...) // Fails as address is taken
+		if err == nil || !strings.Contains(err.Error(), tt.contains) {
+			t.Errorf("Expected error containing %q for Addr %q and %q, got %v", tt.contains, tt.addr, tt.args, err)
+		}
+	}
+}
+
+func TestDegradeOnDBError(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	open := func() (database.Client, error) { return database.New("/nonexistent/GeoLite2-City.mmdb", "", "", "") }
+
+	server := testServer()
+	if err := server.OpenDatabase(open); err == nil {
+		t.Fatal("Expected error when database cannot be opened")
+	}
 
+	server = New(nil)
+	server.DegradeOnDBError = true
+	if err := server.OpenDatabase(open); err == nil {
+		t.Fatal("Expected error to be returned when degrading")
+	}
 	var tests = []struct {
 		url    string
-		out    string
 		status int
+		body   string
 	}{
-		{s.URL + "/port/1337", "404 page not found", 404},
-		{s.URL + "/country", "404 page not found", 404},
-		{s.URL + "/country-iso", "404 page not found", 404},
-		{s.URL + "/city", "404 page not found", 404},
-		{s.URL + "/json", `{"ip":"127.0.0.1","ip_decimal":2130706433}`, 200},
+		{"/json", 200, `{"ip":"127.0.0.1","ip_decimal":2130706433,"family":4}`},
+		{"/ip", 200, "127.0.0.1\n"},
+		{"/country", 404, ""},
 	}
-
+	handler := server.Handler()
 	for _, tt := range tests {
-		out, status, err := httpGet(tt.url, "", "")
-		if err != nil {
-			t.Fatal(err)
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, w.Code)
 		}
-		if status != tt.status {
-			t.Errorf("Expected %d, got %d", tt.status, status)
+		if tt.body != "" && w.Body.String() != tt.body {
+			t.Errorf("Expected %q for %s, got %q", tt.body, tt.url, w.Body.String())
 		}
-		if out != tt.out {
-			t.Errorf("Expected %q, got %q", tt.out, out)
+	}
+}
+
+func TestFixedResponse(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.FixedResponse = &Response{IP: net.ParseIP("192.0.2.1"), IPDecimal: 3221225985, Family: 4, Country: "Norway",
+		City: "Oslo"}
+	var tests = []struct {
+		url string
+		out string
+	}{
+		{"/json", `{"ip":"192.0.2.1","ip_decimal":3221225985,"family":4,"country":"Norway","city":"Oslo"}`},
+		{"/ip", "192.0.2.1\n"},
+		{"/country", "Norway\n"},
+		{"/city", "Oslo\n"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, got)
 		}
 	}
 }
 
-func TestJSONHandlers(t *testing.T) {
+func TestStripSuffix(t *testing.T) {
+	var tests = []struct {
+		hostname string
+		suffixes []string
+		out      string
+	}{
+		{"host.corp.example.com", nil, "host.corp.example.com"},
+		{"host.corp.example.com", []string{"corp.example.com"}, "host"},
+		{"host.corp.example.com.", []string{".corp.example.com."}, "host"},
+		{"host.CORP.example.com", []string{"corp.example.com"}, "host"},
+		{"host.corp.example.com", []string{"example.org", "example.com"}, "host.corp"},
+		{"corp.example.com", []string{"corp.example.com"}, "corp.example.com"},
+		{"hostexample.com", []string{"example.com"}, "hostexample.com"},
+		{"", []string{"example.com"}, ""},
+	}
+	for _, tt := range tests {
+		if got := stripSuffix(tt.hostname, tt.suffixes); got != tt.out {
+			t.Errorf("Expected %q for %q and %q, got %q", tt.out, tt.hostname, tt.suffixes, got)
+		}
+	}
+}
+
+func TestInfoHandler(t *testing.T) {
 	log.SetOutput(ioutil.Discard)
-	s := httptest.NewServer(testServer().Handler())
+	server := testServer()
+	server.Batch = true
+	server.RateLimit = 60
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/info", nil))
+	want := `{"databases":{"city":"GeoLite2-City"},"features":{"batch":true,"bogon":false,"geo":true,"openapi":false,` +
+		`"port_lookup":true,"rate_limit":true,"raw_lookup":false,"resolve":false,"reverse_lookup":true,"tor_exit":false,` +
+		`"verify_hostname":false}}`
+	if got := w.Body.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
 
+	// Custom rate limiter
+	server = testServer()
+	server.RateLimiter = &denyLimiter{}
+	if !server.newInfoResponse().Features["rate_limit"] {
+		t.Error("Expected rate_limit to be true with custom rate limiter")
+	}
+}
+
+func TestSigningKey(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
 	var tests = []struct {
+		key    string
 		url    string
-		out    string
+		signed bool
+	}{
+		{"", "/json", false},
+		{"secret", "/json", true},
+		{"secret", "/whoami", true},
+		{"secret", "/ip", false},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.SigningKey = []byte(tt.key)
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		want := ""
+		if tt.signed {
+			mac := hmac.New(sha256.New, []byte(tt.key))
+			mac.Write(w.Body.Bytes())
+			want = "sha256=" + hex.EncodeToString(mac.Sum(nil))
+		}
+		if got := w.Header().Get("X-Signature"); got != want {
+			t.Errorf("Expected signature %q for %s, got %q", want, tt.url, got)
+		}
+	}
+}
+
+func TestAPIKey(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		keys   []string
+		url    string
+		header string
 		status int
 	}{
-		{s.URL, `{"ip":"127.0.0.1","ip_decimal":2130706433,"country":"Elbonia","country_iso":"EB","city":"Bornyasherk","hostname":"localhost"}`, 200},
-		{s.URL + "/port/foo", `{"error":"Invalid port: 0"}`, 400},
-		{s.URL + "/port/0", `{"error":"Invalid port: 0"}`, 400},
-		{s.URL + "/port/65356", `{"error":"Invalid port: 65356"}`, 400},
-		{s.URL + "/port/31337", `{"ip":"127.0.0.1","port":31337,"reachable":true}`, 200},
-		{s.URL + "/foo", `{"error":"404 page not found"}`, 404},
+		{nil, "/raw", "", 200},
+		{[]string{"foo"}, "/raw", "", 401},
+		{[]string{"foo"}, "/raw", "bar", 401},
+		{[]string{"foo"}, "/raw", "foo", 200},
+		{[]string{"foo", "bar"}, "/raw", "bar", 200},
+		{[]string{"foo"}, "/raw?api_key=foo", "", 200},
+		{[]string{"foo"}, "/json", "", 200},
+		{[]string{"foo"}, "/ip", "", 200},
 	}
+	for _, tt := range tests {
+		server := testServer()
+		server.RawLookup = true
+		server.APIKeys = tt.keys
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		if tt.header != "" {
+			r.Header.Set("X-API-Key", tt.header)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %s with key %q and keys %q, got %d", tt.status, tt.url, tt.header, tt.keys, w.Code)
+		}
+	}
+}
 
+func TestJA3(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	client, _ := net.Pipe()
+	var tests = []struct {
+		tls bool
+		out string
+	}{
+		{false, ""},
+		{true, "0123456789abcdef0123456789abcdef"},
+	}
 	for _, tt := range tests {
-		out, status, err := httpGet(tt.url, jsonMediaType, "curl/7.2.6.0")
-		if err != nil {
+		server := testServer()
+		server.JA3 = func(c net.Conn) string {
+			if c != client {
+				return ""
+			}
+			return "0123456789abcdef0123456789abcdef"
+		}
+		r := httptest.NewRequest("GET", "/json", nil)
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		r = r.WithContext(context.WithValue(r.Context(), connContextKey{}, client))
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
 			t.Fatal(err)
 		}
-		if status != tt.status {
-			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, status)
+		if response.JA3 != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, response.JA3)
 		}
-		if out != tt.out {
-			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, out)
+	}
+}
+
+func TestRequireUserAgent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		require   bool
+		userAgent string
+		status    int
+	}{
+		{false, "", 200},
+		{true, "", 400},
+		{true, " ", 400},
+		{true, "curl/7.26.0", 200},
+		{true, "Wget/1.21", 200},
+		{true, "Mozilla/5.0", 200},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.RequireUserAgent = tt.require
+		r := httptest.NewRequest("GET", "/ip", nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		r.Header.Set("User-Agent", tt.userAgent)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for User-Agent %q, got %d", tt.status, tt.userAgent, w.Code)
 		}
 	}
 }
 
-func TestIPFromRequest(t *testing.T) {
+func TestFormatsHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
 	var tests = []struct {
-		remoteAddr    string
-		headerKey     string
-		headerValue   string
-		trustedHeader string
-		out           string
+		remoteAddr string
+		out        string
 	}{
-		{"127.0.0.1:9999", "", "", "", "127.0.0.1"},                          // No header given
-		{"127.0.0.1:9999", "X-Real-IP", "1.3.3.7", "", "127.0.0.1"},          // Trusted header is empty
-		{"127.0.0.1:9999", "X-Real-IP", "1.3.3.7", "X-Foo-Bar", "127.0.0.1"}, // Trusted header does not match
-		{"127.0.0.1:9999", "X-Real-IP", "1.3.3.7", "X-Real-IP", "1.3.3.7"},   // Trusted header matches
+		{"127.0.0.1:1337", `{"ip":"127.0.0.1","decimal":"2130706433","hex":"0x7f000001",` +
+			`"binary":"01111111000000000000000000000001","reverse_name":"1.0.0.127.in-addr.arpa"}`},
+		{"[2001:db8::29]:1337", `{"ip":"2001:db8::29","decimal":"42540766411282592856903984951653826601",` +
+			`"hex":"0x20010db8000000000000000000000029","binary":"` + "0010000000000001000011011011100" + strings.Repeat("0", 91) + "101001" +
+			`","reverse_name":"9.2.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"}`},
 	}
 	for _, tt := range tests {
-		r := &http.Request{
-			RemoteAddr: tt.remoteAddr,
-			Header:     http.Header{},
+		r := httptest.NewRequest("GET", "/formats", nil)
+		r.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		testServer().Handler().ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.remoteAddr, got)
 		}
-		r.Header.Add(tt.headerKey, tt.headerValue)
-		ip, err := ipFromRequest(tt.trustedHeader, r)
-		if err != nil {
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		enabled bool
+		out     string
+	}{
+		{false, ""},
+		{true, "1.0.0.127.in-addr.arpa"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.ReverseName = tt.enabled
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
 			t.Fatal(err)
 		}
-		out := net.ParseIP(tt.out)
-		if !ip.Equal(out) {
-			t.Errorf("Expected %s, got %s", out, ip)
+		if response.ReverseName != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, response.ReverseName)
+		}
+	}
+}
+
+func TestInvalidClientIP(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		remoteAddr string
+		header     string
+		url        string
+		out        string
+	}{
+		{"127.0.0.1", "", "/ip", "400 bad request"},
+		{"foo:1337", "", "/ip", "400 bad request"},
+		{"", "", "/ip", "400 bad request"},
+		{"127.0.0.1:1337", "foo", "/ip", "400 bad request"},
+		{"127.0.0.1:1337", "foo", "/country", "400 bad request"},
+		{"127.0.0.1", "", "/json", `{"error":"400 bad request"}`},
+		{"127.0.0.1", "", "/port/80", `{"error":"400 bad request"}`},
+		{"127.0.0.1", "", "/whoami", `{"error":"400 bad request"}`},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.IPHeader = "X-Real-IP"
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.header != "" {
+			r.Header.Set("X-Real-IP", tt.header)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != 400 {
+			t.Errorf("Expected 400 for %s with remote address %q and header %q, got %d", tt.url, tt.remoteAddr, tt.header, w.Code)
+		}
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, got)
+		}
+	}
+	if _, _, err := ipFromRequest("", 0, &http.Request{RemoteAddr: "foo"}); !errors.Is(err, errInvalidIP) {
+		t.Errorf("Expected %v, got %v", errInvalidIP, err)
+	}
+}
+
+func TestGeoOverride(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	office, err := ParseGeoOverride("10.0.0.0/8=no,Norway,Oslo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, err := ParseGeoOverride("192.0.2.1=SE,Sweden,Stockholm")
+	if err != nil {
+		t.Fatal(err)
+	}
+	empty, _ := database.New("", "", "", "")
+	var tests = []struct {
+		db         database.Client
+		remoteAddr string
+		out        string
+	}{
+		{&testDb{}, "10.1.2.3:1337", "Oslo\n"},
+		{&testDb{}, "192.0.2.1:1337", "Stockholm\n"},
+		{&testDb{}, "192.0.2.2:1337", "Bornyasherk\n"},
+		{empty, "10.1.2.3:1337", "Oslo\n"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.db = tt.db
+		server.GeoOverrides = []GeoOverride{office, host}
+		r := httptest.NewRequest("GET", "/city", nil)
+		r.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.remoteAddr, got)
+		}
+	}
+	if office.Record.Country.ISO != "NO" || office.Record.Country.Name != "Norway" {
+		t.Errorf("Expected country NO/Norway, got %+v", office.Record.Country)
+	}
+	for _, s := range []string{"10.0.0.0/8", "foo=NO,Norway,Oslo", "10.0.0.0/8=NO,Norway"} {
+		if _, err := ParseGeoOverride(s); err == nil {
+			t.Errorf("Expected error for %q", s)
+		}
+	}
+}
+
+func TestViaProxy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		ipHeader string
+		value    string
+		out      string
+	}{
+		{"", "", "<nil>"},
+		{"X-Real-IP", "", "false"},
+		{"X-Real-IP", "192.0.2.1", "true"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.IPHeader = tt.ipHeader
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		if tt.value != "" {
+			r.Header.Set(tt.ipHeader, tt.value)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		got := "<nil>"
+		if response.ViaProxy != nil {
+			got = strconv.FormatBool(*response.ViaProxy)
+		}
+		if got != tt.out {
+			t.Errorf("Expected via_proxy %s for %s: %q, got %s", tt.out, tt.ipHeader, tt.value, got)
+		}
+	}
+}
+
+func TestAcceptLanguages(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out []string
+	}{
+		{"", []string{}},
+		{"de", []string{"de"}},
+		{"de-AT, en;q=0.5, fr;q=0.8", []string{"de-AT", "fr", "en"}},
+		{"en;q=0, de, *;q=0.1", []string{"de"}},
+		{"fr;q=foo, de;q=0.9", []string{"fr", "de"}},
+	}
+	for _, tt := range tests {
+		if got := acceptLanguages(tt.in); !reflect.DeepEqual(got, tt.out) {
+			t.Errorf("Expected %q for %q, got %q", tt.out, tt.in, got)
+		}
+	}
+}
+
+func TestHostLanguages(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		languages      map[string]string
+		host           string
+		acceptLanguage string
+		out            string
+	}{
+		{nil, "example.de", "", "Elbonia Bornyasherk"},
+		{nil, "example.de", "de", "Elbonien Bornjascherk"},
+		{nil, "example.com", "pt-br, de;q=0.5", "Elbônia Bornjascherk"},
+		{map[string]string{"example.de": "de"}, "example.com", "", "Elbonia Bornyasherk"},
+		{map[string]string{"example.de": "de"}, "example.de", "", "Elbonien Bornjascherk"},
+		{map[string]string{"example.de": "de"}, "example.de:8080", "", "Elbonien Bornjascherk"},
+		{map[string]string{"example.de": "de"}, "example.de", "en-US,en;q=0.9", "Elbonia Bornyasherk"},
+		{map[string]string{"example.de": "de"}, "example.com", "de-AT", "Elbonien Bornjascherk"},
+		{map[string]string{"example.de": "de"}, "example.com", "pt-br", "Elbônia Bornyasherk"},
+		{map[string]string{"example.de": "de"}, "example.de", "ja", "Elbonien Bornjascherk"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.db = &localizedDb{}
+		server.HostLanguages = tt.languages
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.Host = tt.host
+		r.Header.Set("Accept-Language", tt.acceptLanguage)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if got := response.Country + " " + response.City; got != tt.out {
+			t.Errorf("Expected %q for host %s and Accept-Language %q, got %q", tt.out, tt.host, tt.acceptLanguage, got)
+		}
+	}
+}
+
+func TestNoContent(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		noContent bool
+		url       string
+		out       string
+		status    int
+	}{
+		{false, "/country", "\n", 200},
+		{false, "/country-iso", "\n", 200},
+		{true, "/country", "", 204},
+		{true, "/country?iso=1", "", 204},
+		{true, "/country-iso", "", 204},
+		{true, "/country-flag", "", 204},
+		{true, "/city", "Bornyasherk\n", 200},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.db = &emptyCountryDb{}
+		server.NoContent = tt.noContent
+		r := httptest.NewRequest("GET", tt.url, nil)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, w.Code)
+		}
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, got)
+		}
+	}
+}
+
+func TestTextContentType(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		contentType string
+		url         string
+		out         string
+	}{
+		{"", "/ip", "text/plain; charset=utf-8"},
+		{"", "/city", "text/plain; charset=utf-8"},
+		{"", "/all", "text/plain; charset=utf-8"},
+		{"text/plain", "/country", "text/plain; charset=utf-8"},
+		{"application/octet-stream", "/ip", "application/octet-stream; charset=utf-8"},
+		{"text/plain; charset=ISO-8859-1", "/ip-decimal", "text/plain; charset=ISO-8859-1"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.TextContentType = tt.contentType
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Type"); got != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, got)
+		}
+	}
+}
+
+func TestMethodNotAllowed(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.Batch = true
+	var tests = []struct {
+		method string
+		url    string
+		status int
+		allow  string
+	}{
+		{"GET", "/ip", 200, ""},
+		{"TRACE", "/ip", 405, "GET, HEAD"},
+		{"PUT", "/json", 405, "GET, HEAD"},
+		{"DELETE", "/port/80", 405, "GET, HEAD"},
+		{"GET", "/batch.csv", 405, "POST"},
+		{"HEAD", "/batch.csv", 405, "POST"},
+		{"CONNECT", "/", 405, "GET, HEAD"},
+		{"TRACE", "/foo", 404, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %s %s, got %d", tt.status, tt.method, tt.url, w.Code)
+		}
+		if got := w.Header().Get("Allow"); got != tt.allow {
+			t.Errorf("Expected Allow %q for %s %s, got %q", tt.allow, tt.method, tt.url, got)
+		}
+	}
+}
+
+func TestHead(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	var tests = []struct {
+		url         string
+		contentType string
+	}{
+		{"/ip", textMediaType + charsetUTF8},
+		{"/json", jsonContentType},
+		{"/", textMediaType + charsetUTF8},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("HEAD", tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		r.Header.Set("User-Agent", "curl/7.26.0")
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Errorf("Expected 200 for HEAD %s, got %d", tt.url, w.Code)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("Expected Content-Type %q for HEAD %s, got %q", tt.contentType, tt.url, got)
+		}
+		if w.Body.Len() != 0 {
+			t.Errorf("Expected no body for HEAD %s, got %q", tt.url, w.Body.String())
+		}
+	}
+}
+
+func TestCharset(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.Batch = true
+	server.Template = "../index.html"
+	var tests = []struct {
+		method string
+		url    string
+		accept string
+		out    string
+	}{
+		{"GET", "/json", "", "application/json; charset=utf-8"},
+		{"GET", "/", jsonMediaType, "application/json; charset=utf-8"},
+		{"GET", "/", "text/html", "text/html; charset=utf-8"},
+		{"GET", "/whoami", "", "application/json; charset=utf-8"},
+		{"GET", "/port/foo", "", "application/json; charset=utf-8"},
+		{"GET", "/ip6", "", "text/plain; charset=utf-8"},
+		{"POST", "/batch.csv", "", "text/csv; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, strings.NewReader("127.0.0.1\n"))
+		r.RemoteAddr = "127.0.0.1:1337"
+		if tt.accept != "" {
+			r.Header.Set("Accept", tt.accept)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Type"); got != tt.out {
+			t.Errorf("Expected %q for %s %s, got %q", tt.out, tt.method, tt.url, got)
+		}
+	}
+}
+
+func TestDisabledHandlers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.LookupPort = nil
+	server.LookupAddr = nil
+	server.db, _ = database.New("", "", "", "")
+	s := httptest.NewServer(server.Handler())
+
+	var tests = []struct {
+		url    string
+		out    string
+		status int
+	}{
+		{s.URL + "/port/1337", `{"error":"port testing disabled"}`, 501},
+		{s.URL + "/ping/1337", `{"error":"port testing disabled"}`, 501},
+		{s.URL + "/ports", `{"error":"port testing disabled"}`, 501},
+		{s.URL + "/country", "404 page not found", 404},
+		{s.URL + "/country-iso", "404 page not found", 404},
+		{s.URL + "/country-flag", "404 page not found", 404},
+		{s.URL + "/city", "404 page not found", 404},
+		{s.URL + "/json", `{"ip":"127.0.0.1","ip_decimal":2130706433,"family":4}`, 200},
+	}
+
+	for _, tt := range tests {
+		out, status, err := httpGet(tt.url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("Expected %d, got %d", tt.status, status)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, out)
+		}
+	}
+}
+
+func TestRootOrder(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		order []string
+		out   string
+	}{
+		{nil, `{"ip":"127.0.0.1","ip_decimal":2130706433,"family":4}`},
+		{[]string{RootCLI, RootJSON}, "127.0.0.1\n"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.db, _ = database.New("", "", "", "")
+		server.LookupAddr = nil
+		server.RootOrder = tt.order
+		s := httptest.NewServer(server.Handler())
+		out, _, err := httpGet(s.URL, jsonMediaType, "curl/7.26.0")
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q for order %v, got %q", tt.out, tt.order, out)
+		}
+	}
+}
+
+func TestBrowserRoot(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	const (
+		chrome  = "Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36"
+		firefox = "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 Firefox/121.0"
+		safari  = "Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 Mobile/15E148 Safari/604.1"
+	)
+	var tests = []struct {
+		userAgent   string
+		accept      string
+		order       []string
+		contentType string
+	}{
+		{chrome, "text/html,application/xhtml+xml,application/xml;q=0.9,image/avif,image/webp,*/*;q=0.8", nil, htmlMediaType},
+		{firefox, "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", nil, htmlMediaType},
+		{safari, "text/html,application/xhtml+xml,application/xml;q=0.9,*/*;q=0.8", nil, htmlMediaType},
+		{firefox, "text/html", []string{RootText, RootCLI, RootJSON}, htmlMediaType},
+		{firefox, "text/plain", nil, textMediaType},        // Explicitly asking for text
+		{firefox, jsonMediaType, nil, jsonMediaType},       // Explicitly asking for JSON, e.g. from fetch()
+		{"curl/7.26.0", "text/html", nil, textMediaType},   // Not a browser
+		{"Wget/1.21", "text/html,*/*", nil, textMediaType}, // Not a browser
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.Template = "../index.html"
+		server.RootOrder = tt.order
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("User-Agent", tt.userAgent)
+		r.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Type"); !strings.HasPrefix(got, tt.contentType) {
+			t.Errorf("Expected %s for %q accepting %q, got %s", tt.contentType, tt.userAgent, tt.accept, got)
+		}
+	}
+}
+
+func TestDisabledRoutes(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.DisabledRoutes = []string{"/city", "/port"}
+	s := httptest.NewServer(server.Handler())
+
+	var tests = []struct {
+		url    string
+		out    string
+		status int
+	}{
+		{s.URL + "/city", "404 page not found", 404},
+		{s.URL + "/port/1337", "404 page not found", 404},
+		{s.URL + "/country", "Elbonia\n", 200},
+		{s.URL + "/ip", "127.0.0.1\n", 200},
+	}
+
+	for _, tt := range tests {
+		out, status, err := httpGet(tt.url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, out)
+		}
+	}
+}
+
+func TestAllowedHosts(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.AllowedHosts = []string{"example.com"}
+	handler := server.Handler()
+
+	var tests = []struct {
+		host   string
+		accept string
+		out    string
+		status int
+	}{
+		{"example.com", "", "127.0.0.1\n", 200},
+		{"EXAMPLE.com:8080", "", "127.0.0.1\n", 200},
+		{"example.org", "", "421 misdirected request", 421},
+		{"example.org", jsonMediaType, `{"error":"421 misdirected request"}`, 421},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ip", nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		r.Host = tt.host
+		r.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for host %s, got %d", tt.status, tt.host, w.Code)
+		}
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for host %s, got %q", tt.out, tt.host, got)
+		}
+	}
+}
+
+func TestRawHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	s := httptest.NewServer(server.Handler())
+	if _, status, _ := httpGet(s.URL+"/raw", "", ""); status != 404 {
+		t.Errorf("Expected 404 with raw lookup disabled, got %d", status)
+	}
+	s.Close()
+
+	server.RawLookup = true
+	s = httptest.NewServer(server.Handler())
+	defer s.Close()
+	out, status, err := httpGet(s.URL+"/raw", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"city":{"names":{"en":"Bornyasherk"}}}`
+	if status != 200 || out != want {
+		t.Errorf("Expected %d and %q, got %d and %q", 200, want, status, out)
+	}
+}
+
+func TestBatchCSVHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.Batch = true
+	handler := server.Handler()
+
+	var tests = []struct {
+		url    string
+		in     string
+		out    string
+		status int
+	}{
+		{"/batch.csv", "127.0.0.1\n", "127.0.0.1,Elbonia,EB,Bornyasherk,64496\n", 200},
+		{"/batch.csv?column=1", "id,ip\n1,127.0.0.1\n2,foo\n3\n",
+			"id,ip,country,country_iso,city,asn\n1,127.0.0.1,Elbonia,EB,Bornyasherk,64496\n2,foo,,,,\n3,,,,\n", 200},
+		{"/batch.csv?column=2", "id,ip\n", "Column 2 does not exist\n", 400},
+		{"/batch.csv?column=foo", "", "Invalid column: foo\n", 400},
+		{"/batch.csv", "\"foo\n", "Invalid CSV\n", 400},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", tt.url, strings.NewReader(tt.in))
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %q, got %d", tt.status, tt.in, w.Code)
+		}
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for %q, got %q", tt.out, tt.in, got)
+		}
+	}
+}
+
+func TestOpenAPIHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.OpenAPI = true
+	server.DisabledRoutes = []string{"/city"}
+	handler := server.Handler()
+
+	r := httptest.NewRequest("GET", "/openapi.json", nil)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema struct {
+						Properties map[string]interface{} `json:"properties"`
+						Required   []string               `json:"required"`
+					} `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{"/", "/json", "/ip", "/country", "/distance", "/port/{port}", "/ping/{port}", "/openapi.json"} {
+		if _, ok := doc.Paths[path]["get"]; !ok {
+			t.Errorf("Expected path %s to be documented", path)
+		}
+	}
+	if _, ok := doc.Paths["/city"]; ok {
+		t.Errorf("Expected disabled path /city to not be documented")
+	}
+	schema := doc.Paths["/json"]["get"].Responses["200"].Content[jsonMediaType].Schema
+	for _, name := range responseFields() {
+		if _, ok := schema.Properties[name]; !ok {
+			t.Errorf("Expected field %s in schema", name)
+		}
+	}
+	if want := []string{"ip", "ip_decimal", "family"}; !reflect.DeepEqual(schema.Required, want) {
+		t.Errorf("Expected required fields %v, got %v", want, schema.Required)
+	}
+
+	server.CamelCase = true
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/openapi.json", nil))
+	if err := json.Unmarshal(w.Body.Bytes(), &doc); err != nil {
+		t.Fatal(err)
+	}
+	schema = doc.Paths["/json"]["get"].Responses["200"].Content[jsonMediaType].Schema
+	if want := []string{"ip", "ipDecimal", "family"}; !reflect.DeepEqual(schema.Required, want) {
+		t.Errorf("Expected required fields %v, got %v", want, schema.Required)
+	}
+	for _, name := range schema.Required {
+		if _, ok := schema.Properties[name]; !ok {
+			t.Errorf("Expected required field %s in properties", name)
+		}
+	}
+}
+
+type flushRecorder struct {
+	*httptest.ResponseRecorder
+	flushed []string
+}
+
+func (w *flushRecorder) Flush() { w.flushed = append(w.flushed, w.Body.String()) }
+
+func TestBatchCSVTruncated(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.Batch = true
+	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+
+	var tests = []struct {
+		in        string
+		out       string
+		truncated string
+	}{
+		{"127.0.0.1\n", "127.0.0.1,Elbonia,EB,Bornyasherk,64496\n", ""},
+		{"127.0.0.1\n\"foo\n", "127.0.0.1,Elbonia,EB,Bornyasherk,64496\n", "true"},
+	}
+	for _, tt := range tests {
+		res, err := http.Post(s.URL+"/batch.csv", "text/csv", strings.NewReader(tt.in))
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(res.Body) // Trailers are available once the body is read
+		res.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if res.StatusCode != 200 {
+			t.Errorf("Expected 200 for %q, got %d", tt.in, res.StatusCode)
+		}
+		if string(b) != tt.out {
+			t.Errorf("Expected %q for %q, got %q", tt.out, tt.in, string(b))
+		}
+		if got := res.Trailer.Get(batchTruncatedHeader); got != tt.truncated {
+			t.Errorf("Expected %s trailer %q for %q, got %q", batchTruncatedHeader, tt.truncated, tt.in, got)
+		}
+	}
+}
+
+func TestBatchCSVStreaming(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.Batch = true
+	server.AccessLog = ioutil.Discard
+	r := httptest.NewRequest("POST", "/batch.csv", strings.NewReader("ip\n127.0.0.1\n127.0.0.2\n"))
+	w := &flushRecorder{ResponseRecorder: httptest.NewRecorder()}
+	server.Handler().ServeHTTP(w, r)
+	want := []string{
+		"ip,country,country_iso,city,asn\n",
+		"ip,country,country_iso,city,asn\n127.0.0.1,Elbonia,EB,Bornyasherk,64496\n",
+		"ip,country,country_iso,city,asn\n127.0.0.1,Elbonia,EB,Bornyasherk,64496\n127.0.0.2,Elbonia,EB,Bornyasherk,64496\n",
+	}
+	if !reflect.DeepEqual(w.flushed, want) {
+		t.Errorf("Expected flushes %q, got %q", want, w.flushed)
+	}
+}
+
+func TestEventsHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.EventInterval = 10 * time.Millisecond
+	server.MaxStreams = 1
+	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+
+	res, err := http.Get(s.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if got, want := res.Header.Get("Content-Type"), "text/event-stream; charset=utf-8"; got != want {
+		t.Errorf("Expected Content-Type %q, got %q", want, got)
+	}
+	scanner := bufio.NewScanner(res.Body)
+	for i := 0; i < 2; i++ {
+		if !scanner.Scan() {
+			t.Fatalf("Expected event %d, got %v", i, scanner.Err())
+		}
+		if got, want := scanner.Text(), "data: 127.0.0.1"; got != want {
+			t.Errorf("Expected %q, got %q", want, got)
+		}
+		scanner.Scan() // Blank line ending the event
+	}
+
+	// Limit is reached while the first stream is open
+	res2, err := http.Get(s.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	res2.Body.Close()
+	if res2.StatusCode != 503 {
+		t.Errorf("Expected 503, got %d", res2.StatusCode)
+	}
+	if got := res2.Header.Get("Retry-After"); got != "60" {
+		t.Errorf("Expected Retry-After 60, got %q", got)
+	}
+}
+
+func TestServerHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		hostname   string
+		lookupHost func(string) ([]net.IP, error)
+		status     int
+		out        string
+	}{
+		{"", nil, 404, "404 page not found"},
+		{"osl1.example.com", func(string) ([]net.IP, error) {
+			return []net.IP{net.ParseIP("192.0.2.10"), net.ParseIP("2001:db8::10")}, nil
+		}, 200, `{"hostname":"osl1.example.com","ips":["192.0.2.10","2001:db8::10"],"pop":"osl1","region":"eu-north"}`},
+		{"osl1.example.com", func(string) ([]net.IP, error) { return nil, errors.New("lookup failed") },
+			200, `{"hostname":"osl1.example.com","pop":"osl1","region":"eu-north"}`},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.ServerHostname = tt.hostname
+		server.PoP = "osl1"
+		server.Region = "eu-north"
+		server.LookupHost = tt.lookupHost
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/server", nil))
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for hostname %q, got %d", tt.status, tt.hostname, w.Code)
+		}
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, got)
+		}
+	}
+}
+
+func TestSpeedHandlers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.Speed = true
+	server.Gzip = true
+	var tests = []struct {
+		method string
+		url    string
+		body   string
+		status int
+		size   int
+	}{
+		{"GET", "/speed?bytes=5000", "", 200, 5000},
+		{"GET", "/speed?bytes=0", "", 200, 0},
+		{"GET", "/speed?bytes=-1", "", 400, -1},
+		{"GET", "/speed?bytes=104857601", "", 400, -1},
+		{"GET", "/speed?bytes=foo", "", 400, -1},
+		{"POST", "/speed/upload", strings.Repeat("a", 5000), 200, -1},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, strings.NewReader(tt.body))
+		r.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %s %s, got %d", tt.status, tt.method, tt.url, w.Code)
+		}
+		if tt.size >= 0 && w.Body.Len() != tt.size {
+			t.Errorf("Expected %d bytes for %s, got %d", tt.size, tt.url, w.Body.Len())
+		}
+		if got := w.Header().Get("Content-Encoding"); tt.size > 0 && got != "" {
+			t.Errorf("Expected no compression for %s, got %s", tt.url, got)
+		}
+	}
+
+	r := httptest.NewRequest("POST", "/speed/upload", strings.NewReader(strings.Repeat("a", 5000)))
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, r)
+	var response UploadResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	if response.Bytes != 5000 {
+		t.Errorf("Expected 5000 bytes uploaded, got %d", response.Bytes)
+	}
+
+	server.Speed = false
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/speed", nil))
+	if w.Code != 404 {
+		t.Errorf("Expected 404 when disabled, got %d", w.Code)
+	}
+}
+
+func TestDistanceHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	s := httptest.NewServer(testServer().Handler())
+	defer s.Close()
+	unknown := testServer()
+	unknown.db = &emptyCountryDb{}
+	u := httptest.NewServer(unknown.Handler())
+	defer u.Close()
+
+	var tests = []struct {
+		url    string
+		out    string
+		status int
+	}{
+		{s.URL + "/distance?to=59.9139,10.7522", `{"ip":"127.0.0.1","latitude":59.9139,"longitude":10.7522,"distance_km":0}`, 200},
+		{s.URL + "/distance?to=60.3913,5.3221", `{"ip":"127.0.0.1","latitude":59.9139,"longitude":10.7522,"distance_km":305.07}`, 200},
+		{s.URL + "/distance?to=foo", `{"error":"Invalid location, expected ?to=latitude,longitude"}`, 400},
+		{s.URL + "/distance?to=91,0", `{"error":"Invalid location, expected ?to=latitude,longitude"}`, 400},
+		{s.URL + "/distance", `{"error":"Invalid location, expected ?to=latitude,longitude"}`, 400},
+		{u.URL + "/distance?to=0,0", `{"error":"Location of 127.0.0.1 is unknown"}`, 400},
+	}
+	for _, tt := range tests {
+		out, status, err := httpGet(tt.url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, out)
+		}
+	}
+}
+
+func TestJSONHandlers(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	s := httptest.NewServer(testServer().Handler())
+
+	var tests = []struct {
+		url    string
+		out    string
+		status int
+	}{
+		{s.URL, `{"ip":"127.0.0.1","ip_decimal":2130706433,"family":4,"country":"Elbonia","country_iso":"EB","city":"Bornyasherk","hostname":"localhost","isp":"Elbonia Telecom","connection_type":"Cable/DSL"}`, 200},
+		{s.URL + "/json/pretty", "{\n  \"ip\": \"127.0.0.1\",\n  \"ip_decimal\": 2130706433,\n  \"family\": 4,\n  \"country\": \"Elbonia\",\n" +
+			"  \"country_iso\": \"EB\",\n  \"city\": \"Bornyasherk\",\n  \"hostname\": \"localhost\",\n  \"isp\": \"Elbonia Telecom\",\n" +
+			"  \"connection_type\": \"Cable/DSL\"\n}", 200},
+		{s.URL + "/port/foo", `{"error":"Invalid port: 0"}`, 400},
+		{s.URL + "/port/0", `{"error":"Invalid port: 0"}`, 400},
+		{s.URL + "/port/1", `{"ip":"127.0.0.1","port":1,"reachable":true}`, 200},
+		{s.URL + "/port/65356", `{"ip":"127.0.0.1","port":65356,"reachable":true}`, 200},
+		{s.URL + "/port/65535", `{"ip":"127.0.0.1","port":65535,"reachable":true}`, 200},
+		{s.URL + "/port/65536", `{"error":"Invalid port: 0"}`, 400},
+		{s.URL + "/port/31337", `{"ip":"127.0.0.1","port":31337,"reachable":true}`, 200},
+		{s.URL + "/ping/foo", `{"error":"Invalid port: 0"}`, 400},
+		{s.URL + "/port/\uff18\uff10", `{"error":"Invalid port: only digits 0-9 are allowed"}`, 400},
+		{s.URL + "/ping/\uff18\uff10", `{"error":"Invalid port: only digits 0-9 are allowed"}`, 400},
+		{s.URL + "/foo", `{"error":"404 page not found"}`, 404},
+	}
+
+	for _, tt := range tests {
+		out, status, err := httpGet(tt.url, jsonMediaType, "curl/7.2.6.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, out)
+		}
+	}
+}
+
+func TestTorExit(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.LookupAddr = nil
+	server.TorExit = func(ip net.IP) bool { return ip.Equal(net.IPv4(127, 0, 0, 1)) }
+	s := httptest.NewServer(server.Handler())
+
+	out, _, err := httpGet(s.URL+"/json", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"ip":"127.0.0.1","ip_decimal":2130706433,"family":4,"country":"Elbonia","country_iso":"EB","city":"Bornyasherk","isp":"Elbonia Telecom","connection_type":"Cable/DSL","is_tor_exit":true}`
+	if out != want {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+}
+
+func TestNetwork(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		enabled    bool
+		db         database.Client
+		remoteAddr string
+		out        string
+	}{
+		{false, &networkDb{}, "192.0.2.1:1337", ""},
+		{true, &networkDb{}, "192.0.2.1:1337", "192.0.2.0/28"},
+		{true, &testDb{}, "192.0.2.77:1337", "192.0.2.0/24"},
+		{true, &testDb{}, "[2001:db8:1:2::1]:1337", "2001:db8:1::/48"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.Network = tt.enabled
+		server.db = tt.db
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.Network != tt.out {
+			t.Errorf("Expected network %q for %s, got %q", tt.out, tt.remoteAddr, response.Network)
+		}
+	}
+}
+
+func TestASNNetwork(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		db  database.Client
+		out string
+	}{
+		{&testDb{}, ""},
+		{&networkDb{}, "192.0.2.0/28"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.db = tt.db
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.RemoteAddr = "192.0.2.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		var response Response
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		if response.ASNNetwork != tt.out {
+			t.Errorf("Expected asn_network %q, got %q", tt.out, response.ASNNetwork)
+		}
+	}
+}
+
+func TestEnrich(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		nullFields bool
+		extra      map[string]interface{}
+		out        string
+	}{
+		{false, nil, `"city":"Bornyasherk"`},
+		{false, map[string]interface{}{"risk_score": 42}, `"city":"Override",`},
+		{false, map[string]interface{}{"risk_score": 42}, `"risk_score":42}`},
+		{false, map[string]interface{}{"ip": "203.0.113.1", "b": true, "a": "x"}, `"a":"x","b":true}`}, // Standard fields win
+		{true, map[string]interface{}{"risk_score": 42}, `"risk_score":42}`},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.NullFields = tt.nullFields
+		extra := tt.extra
+		server.Enrich = func(ip net.IP, response *Response) {
+			if extra == nil {
+				return
+			}
+			if !ip.Equal(net.ParseIP("192.0.2.1")) {
+				t.Errorf("Expected Enrich to be called with client IP, got %s", ip)
+			}
+			response.City = "Override"
+			response.Extra = extra
+		}
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.RemoteAddr = "192.0.2.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		out := w.Body.String()
+		if !strings.Contains(out, tt.out) {
+			t.Errorf("Expected %s to contain %s", out, tt.out)
+		}
+		if !strings.HasPrefix(out, `{"ip":"192.0.2.1",`) {
+			t.Errorf("Expected client IP first in %s", out)
+		}
+	}
+}
+
+func TestPossibleProxyIP(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		db         database.Client
+		remoteAddr string
+		out        string
+	}{
+		{&testDb{}, "127.0.0.1:1337", ""},
+		{&hostingDb{}, "127.0.0.1:1337", "true"},
+		{&hostingDb{}, "192.0.2.1:1337", "false"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.db = tt.db
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.RemoteAddr = tt.remoteAddr
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		var response map[string]interface{}
+		if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+			t.Fatal(err)
+		}
+		got := ""
+		if v, ok := response["possible_proxy_ip"]; ok {
+			got = fmt.Sprint(v)
+		}
+		if got != tt.out {
+			t.Errorf("Expected possible_proxy_ip %q for %s, got %q", tt.out, tt.remoteAddr, got)
+		}
+	}
+}
+
+func TestBogon(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.LookupAddr = nil
+	server.Bogon = func(ip net.IP) bool { return ip.IsLoopback() }
+	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+
+	var tests = []struct {
+		url string
+		out string
+	}{
+		{s.URL + "/json", `{"ip":"127.0.0.1","ip_decimal":2130706433,"family":4,"country":"Elbonia","country_iso":"EB","city":"Bornyasherk","isp":"Elbonia Telecom","connection_type":"Cable/DSL","is_bogon":true}`},
+		{s.URL + "/bogon", "true\n"},
+	}
+	for _, tt := range tests {
+		out, _, err := httpGet(tt.url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, out)
+		}
+	}
+}
+
+func TestMobileCodes(t *testing.T) {
+	server := testServer()
+	server.db = &mobileDb{}
+	response, err := server.newResponse(&http.Request{RemoteAddr: "127.0.0.1:9999", Header: http.Header{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.MobileCountryCode != "310" || response.MobileNetworkCode != "004" {
+		t.Errorf("Expected MCC %s and MNC %s, got %s and %s", "310", "004", response.MobileCountryCode,
+			response.MobileNetworkCode)
+	}
+}
+
+func TestSourcePort(t *testing.T) {
+	server := testServer()
+	server.SourcePort = true
+	r := &http.Request{RemoteAddr: "127.0.0.1:9999", Header: http.Header{}}
+	response, err := server.newResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.SourcePort != 9999 {
+		t.Errorf("Expected source port %d, got %d", 9999, response.SourcePort)
+	}
+	server.PortHeader = "X-Forwarded-Port"
+	var tests = []struct {
+		value string
+		port  uint16
+	}{
+		{"4711", 4711},
+		{"1234, 4711", 4711},
+		{"foo", 9999},
+		{"", 9999},
+	}
+	for _, tt := range tests {
+		r.Header.Set("X-Forwarded-Port", tt.value)
+		if response, _ := server.newResponse(r); response.SourcePort != tt.port {
+			t.Errorf("Expected source port %d for header %q, got %d", tt.port, tt.value, response.SourcePort)
+		}
+	}
+
+	server.PortHeader = ""
+	var headerTests = []struct {
+		header string
+		value  string
+		port   uint16
+	}{
+		{"Forwarded", `for="192.0.2.1:4711"`, 4711},
+		{"Forwarded", `for="[2001:db8::1]:4711";proto=https`, 4711},
+		{"Forwarded", "for=192.0.2.1", 0}, // Port of the proxy is not the source port
+		{"CloudFront-Viewer-Address", "2001:db8::1:4711", 4711},
+		{"X-Forwarded-For", "192.0.2.1", 0},
+	}
+	for _, tt := range headerTests {
+		server.IPHeader = tt.header
+		r := &http.Request{RemoteAddr: "127.0.0.1:9999", Header: http.Header{}}
+		r.Header.Set(tt.header, tt.value)
+		if got := server.sourcePort(r); got != tt.port {
+			t.Errorf("Expected source port %d for %s %q, got %d", tt.port, tt.header, tt.value, got)
+		}
+	}
+	server.IPHeader = ""
+
+	server.SourcePort = false
+	if response, _ := server.newResponse(r); response.SourcePort != 0 {
+		t.Errorf("Expected no source port, got %d", response.SourcePort)
+	}
+}
+
+func TestConfidence(t *testing.T) {
+	server := testServer()
+	server.db = &enterpriseDb{}
+	r := &http.Request{RemoteAddr: "127.0.0.1:9999", Header: http.Header{}}
+	response, err := server.newResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.CountryConfidence != 99 || response.CityConfidence != 80 {
+		t.Errorf("Expected confidences 99 and 80, got %d and %d", response.CountryConfidence, response.CityConfidence)
+	}
+}
+
+func TestVerifyHostname(t *testing.T) {
+	var tests = []struct {
+		ips []net.IP
+		out bool
+	}{
+		{[]net.IP{net.ParseIP("2001:db8::1"), net.ParseIP("127.0.0.1")}, true},
+		{[]net.IP{net.ParseIP("192.0.2.1")}, false},
+		{nil, false},
+	}
+	r := &http.Request{RemoteAddr: "127.0.0.1:9999", Header: http.Header{}}
+	for _, tt := range tests {
+		server := testServer()
+		server.VerifyHostname = true
+		server.LookupHost = func(host string) ([]net.IP, error) {
+			if host != "localhost" {
+				t.Errorf("Expected lookup of localhost, got %s", host)
+			}
+			if tt.ips == nil {
+				return nil, &net.DNSError{IsNotFound: true}
+			}
+			return tt.ips, nil
+		}
+		response, err := server.newResponse(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if response.HostnameVerified == nil || *response.HostnameVerified != tt.out {
+			t.Errorf("Expected hostname_verified=%t for %v, got %v", tt.out, tt.ips, response.HostnameVerified)
+		}
+	}
+	server := testServer()
+	server.LookupHost = func(string) ([]net.IP, error) { return nil, nil }
+	if response, _ := server.newResponse(r); response.HostnameVerified != nil {
+		t.Error("Expected no hostname_verified when verification is disabled")
+	}
+}
+
+func TestTimestamp(t *testing.T) {
+	server := testServer()
+	r := &http.Request{RemoteAddr: "127.0.0.1:9999", Header: http.Header{}}
+	if response, _ := server.newResponse(r); response.Timestamp != "" {
+		t.Errorf("Expected no timestamp, got %q", response.Timestamp)
+	}
+	server.Timestamp = true
+	before := time.Now().Truncate(time.Second)
+	response, err := server.newResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts, err := time.Parse(time.RFC3339, response.Timestamp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ts.Before(before) || ts.After(time.Now()) || !strings.HasSuffix(response.Timestamp, "Z") {
+		t.Errorf("Expected current UTC timestamp, got %s", response.Timestamp)
+	}
+}
+
+func TestServerName(t *testing.T) {
+	server := testServer()
+	server.ServerName = true
+	r := &http.Request{RemoteAddr: "127.0.0.1:9999", Header: http.Header{}}
+	if response, _ := server.newResponse(r); response.ServerName != "" {
+		t.Errorf("Expected no server name without TLS, got %q", response.ServerName)
+	}
+	r.TLS = &tls.ConnectionState{ServerName: "ifconfig.co"}
+	response, err := server.newResponse(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if response.ServerName != "ifconfig.co" {
+		t.Errorf("Expected server name %q, got %q", "ifconfig.co", response.ServerName)
+	}
+	server.ServerName = false
+	if response, _ := server.newResponse(r); response.ServerName != "" {
+		t.Errorf("Expected no server name, got %q", response.ServerName)
+	}
+}
+
+func TestDecimalString(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.DecimalString = true
+	s := httptest.NewServer(server.Handler())
+
+	out, _, err := httpGet(s.URL+"/json", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := `{"ip":"127.0.0.1","family":4,"country":"Elbonia","country_iso":"EB","city":"Bornyasherk","hostname":"localhost","isp":"Elbonia Telecom","connection_type":"Cable/DSL","ip_decimal":"2130706433"}`
+	if out != want {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+}
+
+func TestPortString(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.PortString = true
+	server.OpenAPI = true
+	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+
+	var tests = []struct {
+		url string
+		out string
+	}{
+		{s.URL + "/port/1337", `{"ip":"127.0.0.1","reachable":true,"port":"1337"}`},
+		{s.URL + "/ports?list=22,1337", `{"ip":"127.0.0.1","open":[22,1337],"closed":[],"ports":[{"ip":"127.0.0.1","reachable":true,"port":"22"},{"ip":"127.0.0.1","reachable":true,"port":"1337"}]}`},
+	}
+	for _, tt := range tests {
+		out, _, err := httpGet(tt.url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, out)
+		}
+	}
+
+	out, _, err := httpGet(s.URL+"/openapi.json", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Responses map[string]struct {
+				Content map[string]struct {
+					Schema struct {
+						Properties map[string]struct {
+							Type string `json:"type"`
+						} `json:"properties"`
+					} `json:"schema"`
+				} `json:"content"`
+			} `json:"responses"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal([]byte(out), &doc); err != nil {
+		t.Fatal(err)
+	}
+	schema := doc.Paths["/port/{port}"]["get"].Responses["200"].Content[jsonMediaType].Schema
+	if got := schema.Properties["port"].Type; got != "string" {
+		t.Errorf("Expected port to be documented as string, got %q", got)
+	}
+}
+
+func TestNullFields(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	nulls := `"country_confidence":null,"city_confidence":null,"hostname":"localhost",` +
+		`"hostname_verified":null,"reverse_name":null,"isp":"Elbonia Telecom","connection_type":"Cable/DSL","mobile_country_code":null,"mobile_network_code":null,"network":null,"asn_network":null,` +
+		`"is_tor_exit":null,"is_bogon":null,"possible_proxy_ip":null,"source_port":null,"forwarded_chain":null,"via_proxy":null,"server_name":null,"ja3":null,"timestamp":null`
+	var tests = []struct {
+		decimalString bool
+		out           string
+	}{
+		{false, `{"ip":"127.0.0.1","ip_decimal":2130706433,"family":4,"country":"Elbonia","country_iso":"EB","country_flag":null,"city":"Bornyasherk",` + nulls + `}`},
+		{true, `{"ip":"127.0.0.1","family":4,"country":"Elbonia","country_iso":"EB","country_flag":null,"city":"Bornyasherk",` + nulls + `,"ip_decimal":"2130706433"}`},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.NullFields = true
+		server.DecimalString = tt.decimalString
+		s := httptest.NewServer(server.Handler())
+		out, _, err := httpGet(s.URL+"/json", "", "")
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, out)
+		}
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	for _, enabled := range []bool{false, true} {
+		server := testServer()
+		server.SecurityHeaders = enabled
+		s := httptest.NewServer(server.Handler())
+		res, err := http.Get(s.URL + "/ip")
+		s.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		res.Body.Close()
+		for _, h := range []string{"Strict-Transport-Security", "X-Content-Type-Options", "Content-Security-Policy"} {
+			if got := res.Header.Get(h) != ""; got != enabled {
+				t.Errorf("Expected header %s present=%t, got %t", h, enabled, got)
+			}
+		}
+	}
+}
+
+func TestAdminHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	public := httptest.NewServer(server.Handler())
+	admin := httptest.NewServer(server.AdminHandler())
+
+	var tests = []struct {
+		url    string
+		out    string
+		status int
+	}{
+		{admin.URL + "/health", "ok\n", 200},
+		{admin.URL + "/ip", "404 page not found", 404},
+		{public.URL + "/health", "404 page not found", 404},
+		{public.URL + "/debug/routes", "404 page not found", 404},
+	}
+
+	for _, tt := range tests {
+		out, status, err := httpGet(tt.url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, out)
+		}
+	}
+}
+
+func TestDebugRoutesHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.RootOrder = []string{RootJSON, RootCLI}
+	server.DisabledRoutes = []string{"/ports"}
+	server.Handler()
+	r := httptest.NewRequest("GET", "/debug/routes", nil)
+	w := httptest.NewRecorder()
+	server.AdminHandler().ServeHTTP(w, r)
+	var response DebugRoutesResponse
+	if err := json.Unmarshal(w.Body.Bytes(), &response); err != nil {
+		t.Fatal(err)
+	}
+	want := []DebugRoute{
+		{Method: "GET", Path: "/", Condition: "Browser accepting HTML"},
+		{Method: "GET", Path: "/", Condition: "Accept: application/json"},
+		{Method: "GET", Path: "/", Condition: "User-Agent of command-line client"},
+	}
+	if !reflect.DeepEqual(response.Routes[:3], want) {
+		t.Errorf("Expected %+v, got %+v", want, response.Routes[:3])
+	}
+	found := make(map[string]DebugRoute)
+	for _, route := range response.Routes {
+		found[route.Path] = route
+	}
+	if route, ok := found["/port/"]; !ok || !route.Prefix {
+		t.Errorf("Expected prefix route /port/, got %+v", route)
+	}
+	if _, ok := found["/ports"]; ok {
+		t.Error("Expected disabled route /ports to be omitted")
+	}
+}
+
+func TestAltSvc(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		port int
+		tls  bool
+		out  string
+	}{
+		{0, true, ""},
+		{443, false, ""},
+		{443, true, `h3=":443"; ma=86400`},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.HTTP3Port = tt.port
+		r := httptest.NewRequest("GET", "/ip", nil)
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Header().Get("Alt-Svc"); got != tt.out {
+			t.Errorf("Expected Alt-Svc %q for port %d and TLS %t, got %q", tt.out, tt.port, tt.tls, got)
+		}
+	}
+}
+
+func TestRedirectHTTPS(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.RedirectHTTPS = true
+	server.ForwardedURL = true
+	server.TrustedProxy = func(ip net.IP) bool { return ip.Equal(net.IPv4(192, 0, 2, 1)) }
+	var tests = []struct {
+		method     string
+		url        string
+		host       string
+		userAgent  string
+		tls        bool
+		remoteAddr string
+		proto      string
+		status     int
+		location   string
+	}{
+		{"GET", "/json?foo=bar", "example.com", "Mozilla/5.0", false, "", "", 301, "https://example.com/json?foo=bar"},
+		{"GET", "/", "example.com:8443", "Mozilla/5.0", false, "", "", 301, "https://example.com:8443/"},
+		{"GET", "/", "[2001:db8::1]:8443", "Mozilla/5.0", false, "", "", 301, "https://[2001:db8::1]:8443/"},
+		{"GET", "/", "example.com", "curl/7.26.0", false, "", "", 200, ""},
+		{"GET", "/ip", "example.com", "Wget/1.21", false, "", "", 200, ""},
+		{"GET", "/ip", "example.com", "Mozilla/5.0", true, "", "", 200, ""},
+		{"POST", "/batch.csv", "example.com", "Mozilla/5.0", false, "", "", 404, ""},
+		{"GET", "/ip", "example.com", "Mozilla/5.0", false, "", "https", 200, ""},                                    // TLS terminated by trusted proxy
+		{"GET", "/", "example.com", "Mozilla/5.0", false, "198.51.100.1:1234", "https", 301, "https://example.com/"}, // Untrusted proxy
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.url, nil)
+		r.Host = tt.host
+		r.Header.Set("User-Agent", tt.userAgent)
+		r.Header.Set("Accept", htmlMediaType)
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		if tt.remoteAddr != "" {
+			r.RemoteAddr = tt.remoteAddr
+		}
+		if tt.proto != "" {
+			r.Header.Set("X-Forwarded-Proto", tt.proto)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %s %s, got %d", tt.status, tt.method, tt.url, w.Code)
+		}
+		if got := w.Header().Get("Location"); got != tt.location {
+			t.Errorf("Expected Location %q for %s %s, got %q", tt.location, tt.method, tt.url, got)
+		}
+	}
+}
+
+func TestIPResponseHeader(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		enabled bool
+		url     string
+		out     string
+	}{
+		{false, "/ip", ""},
+		{true, "/ip", "127.0.0.1"},
+		{true, "/json", "127.0.0.1"},
+		{true, "/foo", "127.0.0.1"}, // Also set for errors
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.IPResponseHeader = tt.enabled
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Header().Get("X-Your-IP"); got != tt.out {
+			t.Errorf("Expected X-Your-IP %q for %s, got %q", tt.out, tt.url, got)
+		}
+	}
+}
+
+func TestTemplateCaching(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	f, err := ioutil.TempFile("", "ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	for _, devMode := range []bool{false, true} {
+		if err := ioutil.WriteFile(f.Name(), []byte("{{ .IP }}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		server := testServer()
+		server.Template = f.Name()
+		server.DevMode = devMode
+		s := httptest.NewServer(server.Handler())
+		if out, _, err := httpGet(s.URL, "", ""); err != nil || out != "127.0.0.1" {
+			t.Fatalf("Expected %q, got %q (%v)", "127.0.0.1", out, err)
+		}
+		if err := ioutil.WriteFile(f.Name(), []byte("{{ .Country }}"), 0644); err != nil {
+			t.Fatal(err)
+		}
+		want := "127.0.0.1"
+		if devMode {
+			want = "Elbonia"
+		}
+		out, _, err := httpGet(s.URL, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != want {
+			t.Errorf("Expected %q with DevMode=%t, got %q", want, devMode, out)
+		}
+		s.Close()
+	}
+}
+
+func TestHostTemplates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	files := map[string]string{"default.html": "default", "example.html": "example"}
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	server := testServer()
+	server.Template = filepath.Join(dir, "default.html")
+	server.HostTemplates = map[string]string{"example.com": filepath.Join(dir, "example.html")}
+
+	var tests = []struct {
+		host string
+		out  string
+	}{
+		{"example.com", "example"},
+		{"example.com:8080", "example"},
+		{"example.org", "default"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Host = tt.host
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for host %s, got %q", tt.out, tt.host, got)
+		}
+	}
+}
+
+func TestErrorTemplate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	f, err := ioutil.TempFile("", "ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("<h1>{{ .Code }} {{ .Status }}</h1><p>{{ .Message }}</p>")
+	f.Close()
+
+	var tests = []struct {
+		template    string
+		url         string
+		accept      string
+		out         string
+		contentType string
+	}{
+		{"", "/foo", "text/html", "404 page not found", "text/plain; charset=utf-8"},
+		{f.Name(), "/foo", "text/html,application/xhtml+xml", "<h1>404 Not Found</h1><p>404 page not found</p>", "text/html; charset=utf-8"},
+		{f.Name(), "/foo", "", "404 page not found", "text/plain; charset=utf-8"},
+		{f.Name(), "/port/foo", "text/html", `{"error":"Invalid port: 0"}`, "application/json; charset=utf-8"},
+		{"/does/not/exist", "/foo", "text/html", "404 page not found", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.ErrorTemplate = tt.template
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.Header.Set("Accept", tt.accept)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := strings.TrimSpace(w.Body.String()); got != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, got)
+		}
+		if got := w.Header().Get("Content-Type"); got != tt.contentType {
+			t.Errorf("Expected Content-Type %q for %s, got %q", tt.contentType, tt.url, got)
+		}
+	}
+}
+
+func TestTemplateMap(t *testing.T) {
+	f, err := ioutil.TempFile("", "ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("{{ with .Map }}{{ .Latitude }},{{ .Longitude }} {{ .Zoom }}/{{ .TileX }}/{{ .TileY }}{{ end }}")
+	f.Close()
+
+	var tests = []struct {
+		db  database.Client
+		out string
+	}{
+		{&testDb{}, "59.9139,10.7522 11/1085/595"},
+		{&emptyCountryDb{}, ""},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.db = tt.db
+		server.Template = f.Name()
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, got)
+		}
+	}
+}
+
+func TestAbsoluteURL(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	var tests = []struct {
+		forwardedURL bool
+		tls          bool
+		remoteAddr   string
+		headers      map[string]string
+		out          string
+	}{
+		{false, false, "10.0.0.1:1337", nil, "http://example.com/json"},
+		{false, true, "10.0.0.1:1337", nil, "https://example.com/json"},
+		{false, false, "10.0.0.1:1337", map[string]string{"X-Forwarded-Proto": "https"}, "http://example.com/json"},
+		{true, false, "10.0.0.1:1337", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "ip.example"}, "https://ip.example/json"},
+		{true, false, "10.0.0.1:1337", map[string]string{"X-Forwarded-Proto": "HTTPS, http", "X-Forwarded-Host": "a.example, b.example"}, "https://a.example/json"},
+		{true, false, "10.0.0.1:1337", map[string]string{"X-Forwarded-Proto": "ftp", "X-Forwarded-Host": "evil.example/x"}, "http://example.com/json"},
+		{true, false, "192.0.2.1:1337", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "ip.example"}, "http://example.com/json"}, // Untrusted
+		{true, false, "", map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "evil.example"}, "http://example.com/json"},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.ForwardedURL = tt.forwardedURL
+		server.TrustedProxy = trusted.Contains
+		if tt.remoteAddr == "" { // No trusted proxies
+			server.TrustedProxy = nil
+			tt.remoteAddr = "10.0.0.1:1337"
+		}
+		r := httptest.NewRequest("GET", "/", nil)
+		r.RemoteAddr = tt.remoteAddr
+		if tt.tls {
+			r.TLS = &tls.ConnectionState{}
+		}
+		for k, v := range tt.headers {
+			r.Header.Set(k, v)
+		}
+		if got := server.AbsoluteURL(r, "json"); got != tt.out {
+			t.Errorf("Expected %s for %s with headers %v, got %s", tt.out, tt.remoteAddr, tt.headers, got)
+		}
+	}
+}
+
+func TestCLITemplate(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "cli.txt")
+	content := "IP: {{ .IP }}\nLocation: {{ .City }}, {{ .Country }}\nHostname: {{ .Hostname }}\n"
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		template string
+		url      string
+		out      string
+	}{
+		{"", "/", "192.0.2.1\n"},
+		{path, "/", "IP: 192.0.2.1\nLocation: Bornyasherk, Elbonia\nHostname: localhost\n"},
+		{path, "/ip", "192.0.2.1\n"}, // Only applies to root
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.CLITemplate = tt.template
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "192.0.2.1:1337"
+		r.Header.Set("User-Agent", "curl/7.26.0")
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for %s with template %q, got %q", tt.out, tt.url, tt.template, got)
+		}
+	}
+}
+
+func TestCheckTemplates(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	dir, err := ioutil.TempDir("", "ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	templates := map[string]string{
+		"valid.html":   "{{ .IP }} {{ .Host }} {{ with .Map }}{{ .Zoom }}{{ end }}",
+		"missing.html": "<p>{{ .IP }}</p>{{ .NoSuchField }}",
+		"invalid.html": "{{ .IP ",
+		"error.html":   "{{ .Code }} {{ .Status }} {{ .Message }}",
+	}
+	for name, content := range templates {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var tests = []struct {
+		template      string
+		hostTemplates map[string]string
+		err           string
+		status        int
+	}{
+		{"valid.html", nil, "", 200},
+		{"missing.html", nil, "can't evaluate field NoSuchField", 500},
+		{"invalid.html", nil, "unclosed action", 500},
+		{"valid.html", map[string]string{"other.example": "missing.html"}, "can't evaluate field NoSuchField", 200},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.Template = filepath.Join(dir, tt.template)
+		server.HostTemplates = make(map[string]string)
+		for host, name := range tt.hostTemplates {
+			server.HostTemplates[host] = filepath.Join(dir, name)
+		}
+		err := server.CheckTemplates()
+		if tt.err == "" && err != nil {
+			t.Errorf("Expected no error for %s, got %s", tt.template, err)
+		} else if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("Expected error containing %q for %s, got %v", tt.err, tt.template, err)
+		}
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, httptest.NewRequest("GET", "/", nil))
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.template, w.Code)
+		}
+		if w.Code == 500 && strings.Contains(w.Body.String(), "<p>") {
+			t.Errorf("Expected no partial output for %s, got %q", tt.template, w.Body.String())
+		}
+	}
+
+	for name, want := range map[string]string{"error.html": "", "valid.html": "can't evaluate field IP", "invalid.html": "unclosed action"} {
+		server := testServer()
+		server.ErrorTemplate = filepath.Join(dir, name)
+		err := server.CheckTemplates()
+		if want == "" && err != nil {
+			t.Errorf("Expected no error for error template %s, got %s", name, err)
+		} else if want != "" && (err == nil || !strings.Contains(err.Error(), want)) {
+			t.Errorf("Expected error containing %q for error template %s, got %v", want, name, err)
+		}
+	}
+}
+
+func TestUnknownCountry(t *testing.T) {
+	f, err := ioutil.TempFile("", "ipd")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	if err := ioutil.WriteFile(f.Name(), []byte("{{ .Country }} {{ .JSON }}"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	server := testServer()
+	server.LookupAddr = nil
+	server.db = &emptyCountryDb{}
+	server.Template = f.Name()
+	server.UnknownCountry = "Unknown"
+
+	r := httptest.NewRequest("GET", "/", nil)
+	r.RemoteAddr = "127.0.0.1:1337"
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, r)
+	want := "Unknown {\n  &#34;ip&#34;: &#34;127.0.0.1&#34;,\n  &#34;ip_decimal&#34;: 2130706433,\n  &#34;family&#34;: 4,\n  &#34;city&#34;: &#34;Bornyasherk&#34;,\n  &#34;isp&#34;: &#34;Elbonia Telecom&#34;,\n  &#34;connection_type&#34;: &#34;Cable/DSL&#34;\n}"
+	if got := w.Body.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestCamelCase(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.CamelCase = true
+	s := httptest.NewServer(server.Handler())
+
+	var tests = []struct {
+		url string
+		out string
+	}{
+		{s.URL + "/json", `{"ip":"127.0.0.1","ipDecimal":2130706433,"family":4,"country":"Elbonia","countryIso":"EB","city":"Bornyasherk","hostname":"localhost","isp":"Elbonia Telecom","connectionType":"Cable/DSL"}`},
+		{s.URL + "/port/31337", `{"ip":"127.0.0.1","port":31337,"reachable":true}`},
+	}
+	for _, tt := range tests {
+		out, _, err := httpGet(tt.url, "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, out)
+		}
+	}
+}
+
+func TestRewriteKeys(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{`{}`, `{}`},
+		{`{"foo_bar":"baz_qux","a_b":[{"c_d":1},null,true,"e_f"],"g":{"h_i":{}}}`, `{"fooBar":"baz_qux","aB":[{"cD":1},null,true,"e_f"],"g":{"hI":{}}}`},
+		{`[1,2,{"x_y":"\u003c"}]`, `[1,2,{"xY":"\u003c"}]`},
+	}
+	for _, tt := range tests {
+		out, err := rewriteKeys([]byte(tt.in), camelCase)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != tt.out {
+			t.Errorf("Expected %s, got %s", tt.out, out)
+		}
+	}
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestDialError(t *testing.T) {
+	var tests = []struct {
+		err error
+		out string
+	}{
+		{nil, ""},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, "connection refused"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.EHOSTUNREACH)}, "host unreachable"},
+		{&net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ENETUNREACH)}, "network unreachable"},
+		{&net.OpError{Op: "dial", Err: timeoutError{}}, "timeout"},
+		{errors.New("foo"), "unreachable"},
+	}
+	for _, tt := range tests {
+		if got := dialError(tt.err); got != tt.out {
+			t.Errorf("Expected %q for %v, got %q", tt.out, tt.err, got)
+		}
+	}
+
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.LookupPort = func(net.IP, uint64) error {
+		return &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}
+	}
+	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+	out, _, err := httpGet(s.URL+"/port/31337", jsonMediaType, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"ip":"127.0.0.1","port":31337,"reachable":false,"error":"connection refused"}`; out != want {
+		t.Errorf("Expected %q, got %q", want, out)
+	}
+}
+
+func TestWhoamiHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	r := httptest.NewRequest("GET", "/whoami", nil)
+	r.RemoteAddr = "127.0.0.1:1337"
+	r.Header.Set("User-Agent", "curl/7.26.0")
+	r.Header.Set("Authorization", "Bearer secret")
+	r.Header.Set("Cookie", "session=secret")
+	r.Header.Add("X-Foo", "bar")
+	r.Header.Add("X-Foo", "baz")
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, r)
+
+	want := `{"ip":"127.0.0.1","user_agent":{"product":"curl","version":"7.26.0","raw_value":"curl/7.26.0"},` +
+		`"headers":{"Authorization":"[redacted]","Cookie":"[redacted]","User-Agent":"curl/7.26.0","X-Foo":"bar, baz"}}`
+	if got := w.Body.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+
+	// Custom API key header
+	server.APIKeyHeader = "x-my-key"
+	r = httptest.NewRequest("GET", "/whoami", nil)
+	r.RemoteAddr = "127.0.0.1:1337"
+	r.Header.Set("X-My-Key", "secret")
+	r.Header.Set("X-Api-Key", "secret")
+	w = httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, r)
+	want = `{"ip":"127.0.0.1","headers":{"X-Api-Key":"[redacted]","X-My-Key":"[redacted]"}}`
+	if got := w.Body.String(); got != want {
+		t.Errorf("Expected %q, got %q", want, got)
+	}
+}
+
+func TestPortPath(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.MaxPathLength = 64
+	handler := server.Handler()
+
+	var tests = []struct {
+		path   string
+		status int
+	}{
+		{"/port/80", 200},
+		{"/port/../etc", 400},
+		{"/port/80/", 400},
+		{"/port/foo/80", 400},
+		{"/port/../80", 400},
+		{"/port/\u0668\u0660", 400}, // Arabic-Indic digits
+		{"/ping/80/", 400},
+		{"/port/" + strings.Repeat("8", 64), 400},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.URL.Path = tt.path
+		r.RemoteAddr = "127.0.0.1:1337"
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if w.Code != tt.status {
+			t.Errorf("Expected %d for %q, got %d", tt.status, tt.path, w.Code)
+		}
+	}
+
+	r := httptest.NewRequest("GET", "/ip", nil)
+	r.URL.Path = "/" + strings.Repeat("a", 64)
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, r)
+	if want := "400 bad request"; w.Code != 400 || w.Body.String() != want {
+		t.Errorf("Expected 400 and %q for long path, got %d and %q", want, w.Code, w.Body.String())
+	}
+}
+
+func TestPingHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	attempts := 0
+	server.LookupPort = func(net.IP, uint64) error {
+		attempts++
+		time.Sleep(time.Millisecond)
+		return nil
+	}
+	s := httptest.NewServer(server.Handler())
+
+	var tests = []struct {
+		url      string
+		attempts int
+	}{
+		{s.URL + "/ping/31337", 1},
+		{s.URL + "/ping/31337?attempts=3", 3},
+		{s.URL + "/ping/31337?attempts=0", 1},
+		{s.URL + "/ping/31337?attempts=100", maxPingAttempts},
+	}
+
+	for _, tt := range tests {
+		attempts = 0
+		out, status, err := httpGet(tt.url, jsonMediaType, "curl/7.2.6.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != 200 {
+			t.Errorf("Expected 200 for %s, got %d", tt.url, status)
+		}
+		if attempts != tt.attempts {
+			t.Errorf("Expected %d attempts for %s, got %d", tt.attempts, tt.url, attempts)
+		}
+		var response PortResponse
+		if err := json.Unmarshal([]byte(out), &response); err != nil {
+			t.Fatal(err)
+		}
+		if !response.Reachable || response.RTT < 1 {
+			t.Errorf("Expected reachable port with RTT >= 1ms for %s, got %q", tt.url, out)
+		}
+	}
+}
+
+func TestPortsHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.LookupPort = func(ip net.IP, port uint64) error {
+		if port%2 == 0 {
+			return nil
+		}
+		return fmt.Errorf("port %d closed", port)
+	}
+	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+
+	var tests = []struct {
+		url    string
+		open   []uint64
+		closed []uint64
+		status int
+	}{
+		{s.URL + "/ports?list=22,80,443", []uint64{22, 80}, []uint64{443}, 200},
+		{s.URL + "/ports?list=8000-8003,8001", []uint64{8000, 8002}, []uint64{8001, 8003}, 200},
+		{s.URL + "/ports?list=1-33", nil, nil, 400},
+		{s.URL + "/ports?list=80-22", nil, nil, 400},
+		{s.URL + "/ports?list=0", nil, nil, 400},
+		{s.URL + "/ports?list=\uff18\uff10", nil, nil, 400},
+		{s.URL + "/ports?list=65536", nil, nil, 400},
+		{s.URL + "/ports", nil, nil, 400},
+	}
+	for _, tt := range tests {
+		out, status, err := httpGet(tt.url, jsonMediaType, "curl/7.2.6.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if status != 200 {
+			continue
+		}
+		var response PortsResponse
+		if err := json.Unmarshal([]byte(out), &response); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(response.Open, tt.open) || !reflect.DeepEqual(response.Closed, tt.closed) {
+			t.Errorf("Expected open %v and closed %v for %s, got %q", tt.open, tt.closed, tt.url, out)
+		}
+		if len(response.Ports) != len(tt.open)+len(tt.closed) {
+			t.Errorf("Expected details for all ports for %s, got %q", tt.url, out)
+		}
+	}
+}
+
+func TestResolveHandler(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.Resolve = true
+	server.LookupHost = func(host string) ([]net.IP, error) {
+		switch host {
+		case "example.com":
+			return []net.IP{net.ParseIP("192.0.2.1"), net.ParseIP("2001:db8::1")}, nil
+		case "down.example.com":
+			return nil, &net.DNSError{Err: "server failure", IsTemporary: true}
+		}
+		return nil, &net.DNSError{Err: "no such host", IsNotFound: true}
+	}
+	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+
+	var tests = []struct {
+		url    string
+		out    string
+		status int
+	}{
+		{s.URL + "/resolve/example.com", `{"hostname":"example.com","ips":["192.0.2.1","2001:db8::1"]}`, 200},
+		{s.URL + "/resolve/foo.example.com", `{"error":"No such host: foo.example.com"}`, 404},
+		{s.URL + "/resolve/down.example.com", `{"error":"Service unavailable"}`, 503},
+		{s.URL + "/resolve/foo..example.com", `{"error":"Invalid hostname: foo..example.com"}`, 400},
+		{s.URL + "/resolve/", `{"error":"Invalid hostname: "}`, 400},
+	}
+	for _, tt := range tests {
+		out, status, err := httpGet(tt.url, jsonMediaType, "curl/7.26.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if status != tt.status {
+			t.Errorf("Expected %d for %s, got %d", tt.status, tt.url, status)
+		}
+		if out != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.url, out)
+		}
+	}
+
+	server.ResolveRateLimit = 1
+	limited := httptest.NewServer(server.Handler())
+	defer limited.Close()
+	for i, status := range []int{200, 429} {
+		_, got, err := httpGet(limited.URL+"/resolve/example.com", jsonMediaType, "curl/7.26.0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != status {
+			t.Errorf("#%d: Expected %d, got %d", i, status, got)
+		}
+	}
+	server.ResolveRateLimit = 0
+
+	server.Resolve = false
+	s2 := httptest.NewServer(server.Handler())
+	defer s2.Close()
+	if _, status, _ := httpGet(s2.URL+"/resolve/example.com", "", ""); status != 404 {
+		t.Errorf("Expected 404 with resolving disabled, got %d", status)
+	}
+}
+
+func TestPortTargetIP(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	var tests = []struct {
+		url     string
+		header  string
+		value   string
+		ipAllow bool
+	}{
+		{"/port/80", "X-Forwarded-For", "203.0.113.1", false},
+		{"/ping/80", "X-Forwarded-For", "203.0.113.1", false},
+		{"/ports?list=80,443", "X-Forwarded-For", "203.0.113.1", false},
+		{"/port/80?ip=203.0.113.1", "X-Real-IP", "203.0.113.1", false},
+		{"/port/80", "Forwarded", "for=203.0.113.1", false},
+		{"/port/80", "X-Forwarded-For", "203.0.113.1", true}, // Even when other endpoints accept IPs in the path
+	}
+	for _, tt := range tests {
+		var mu sync.Mutex
+		var dialed []string
+		server := testServer()
+		server.IPHeader = tt.header
+		server.IPLookup = tt.ipAllow
+		server.LookupPort = func(ip net.IP, port uint64) error {
+			mu.Lock()
+			defer mu.Unlock()
+			dialed = append(dialed, ip.String())
+			return nil
+		}
+		r := httptest.NewRequest("GET", tt.url, nil)
+		r.RemoteAddr = "192.0.2.1:1337"
+		r.Header.Set(tt.header, tt.value)
+		w := httptest.NewRecorder()
+		server.Handler().ServeHTTP(w, r)
+		if w.Code != 200 {
+			t.Fatalf("Expected 200 for %s, got %d", tt.url, w.Code)
+		}
+		if len(dialed) == 0 {
+			t.Errorf("Expected %s to dial", tt.url)
+		}
+		for _, ip := range dialed {
+			if ip != "192.0.2.1" {
+				t.Errorf("Expected %s with %s: %s to dial peer address, got %s", tt.url, tt.header, tt.value, ip)
+			}
+		}
+		if strings.Contains(w.Body.String(), "203.0.113.1") {
+			t.Errorf("Expected response of %s to not contain spoofed IP: %s", tt.url, w.Body.String())
+		}
+	}
+}
+
+func TestDialLimiter(t *testing.T) {
+	a, b, c := net.ParseIP("192.0.2.1"), net.ParseIP("192.0.2.2"), net.ParseIP("192.0.2.3")
+	l := newDialLimiter(4, 3)
+	var tests = []struct {
+		ip      net.IP
+		acquire int
+		release int
+		out     int
+	}{
+		{a, 1, 0, 1},
+		{a, 8, 0, 2}, // Limited by client
+		{a, 1, 0, 0},
+		{b, 8, 0, 1}, // Limited by server
+		{c, 1, 0, 0},
+		{a, 0, 3, 0},
+		{c, 8, 0, 3},
+	}
+	for i, tt := range tests {
+		if tt.release > 0 {
+			l.release(tt.ip, tt.release)
+			continue
+		}
+		if got := l.acquire(tt.ip, tt.acquire); got != tt.out {
+			t.Errorf("#%d: Expected %d dials for %s, got %d", i, tt.out, tt.ip, got)
+		}
+	}
+	if _, ok := l.clients[a.String()]; ok {
+		t.Errorf("Expected client without dials to be removed")
+	}
+}
+
+func TestMaxClientDials(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	started := make(chan struct{})
+	done := make(chan struct{})
+	server := testServer()
+	server.MaxDials = 2
+	server.MaxClientDials = 1
+	server.LookupPort = func(ip net.IP, port uint64) error {
+		if port == 22 {
+			started <- struct{}{}
+			<-done
+		}
+		return nil
+	}
+	handler := server.Handler()
+	get := func(url, remoteAddr string) int {
+		r := httptest.NewRequest("GET", url, nil)
+		r.RemoteAddr = remoteAddr
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w.Code
+	}
+	go get("/port/22", "192.0.2.1:1337")
+	<-started
+	var tests = []struct {
+		url        string
+		remoteAddr string
+		status     int
+	}{
+		{"/port/80", "192.0.2.1:1337", 429},
+		{"/ping/80", "192.0.2.1:1337", 429},
+		{"/ports?list=80,443", "192.0.2.1:1337", 429},
+		{"/port/80", "192.0.2.2:1337", 200},
+		{"/ports?list=80,443", "192.0.2.2:1337", 200},
+	}
+	for _, tt := range tests {
+		if got := get(tt.url, tt.remoteAddr); got != tt.status {
+			t.Errorf("Expected %d for %s from %s, got %d", tt.status, tt.url, tt.remoteAddr, got)
+		}
+	}
+	close(done)
+}
+
+func TestMaxLookups(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.MaxLookups = 1
+	inLookup := make(chan bool)
+	done := make(chan bool)
+	server.LookupAddr = func(context.Context, net.IP) (string, error) {
+		inLookup <- true
+		<-done
+		return "localhost", nil
+	}
+	s := httptest.NewServer(server.Handler())
+	defer s.Close()
+
+	go httpGet(s.URL+"/json", "", "")
+	<-inLookup
+	res, err := http.Get(s.URL + "/json")
+	close(done)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode != 503 {
+		t.Errorf("Expected 503, got %d", res.StatusCode)
+	}
+	if got := res.Header.Get("Retry-After"); got != "1" {
+		t.Errorf("Expected Retry-After 1, got %q", got)
+	}
+}
+
+func TestGzip(t *testing.T) {
+	body := strings.Repeat("a", 100)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(body))
+	})
+	var tests = []struct {
+		minSize        int
+		acceptEncoding string
+		gzip           bool
+	}{
+		{50, "gzip, deflate", true},
+		{100, "gzip", true},
+		{101, "gzip", false},
+		{50, "", false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", tt.acceptEncoding)
+		w := httptest.NewRecorder()
+		gzipHandler(handler, tt.minSize).ServeHTTP(w, r)
+		if got := w.Header().Get("Content-Encoding") == "gzip"; got != tt.gzip {
+			t.Errorf("Expected gzip=%t for min size %d and Accept-Encoding %q, got %t", tt.gzip, tt.minSize,
+				tt.acceptEncoding, got)
+		}
+		out := w.Body.Bytes()
+		if tt.gzip {
+			gz, err := gzip.NewReader(w.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if out, err = ioutil.ReadAll(gz); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if string(out) != body {
+			t.Errorf("Expected %q, got %q", body, out)
+		}
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	now := time.Now()
+	l := newRateLimiter(60, 2)
+	l.now = func() time.Time { return now }
+	var tests = []struct {
+		key     string
+		advance time.Duration
+		out     bool
+	}{
+		{"a", 0, true},
+		{"a", 0, true},
+		{"a", 0, false},
+		{"b", 0, true},
+		{"a", 500 * time.Millisecond, false},
+		{"a", 500 * time.Millisecond, true},
+		{"a", 0, false},
+		{"a", time.Hour, true},
+		{"a", 0, true},
+		{"a", 0, false},
+	}
+	for i, tt := range tests {
+		now = now.Add(tt.advance)
+		if got := l.Allow(tt.key); got != tt.out {
+			t.Errorf("#%d: Expected %t for %s, got %t", i, tt.out, tt.key, got)
+		}
+	}
+}
+
+type denyLimiter struct{ keys []string }
+
+func (l *denyLimiter) Allow(key string) bool {
+	l.keys = append(l.keys, key)
+	return false
+}
+
+func TestCustomRateLimiter(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	limiter := &denyLimiter{}
+	server := testServer()
+	server.RateLimiter = limiter
+	r := httptest.NewRequest("GET", "/ip", nil)
+	r.RemoteAddr = "192.0.2.1:1337"
+	w := httptest.NewRecorder()
+	server.Handler().ServeHTTP(w, r)
+	if w.Code != 429 {
+		t.Errorf("Expected 429, got %d", w.Code)
+	}
+	if got := w.Header().Get("Retry-After"); got != "60" {
+		t.Errorf("Expected Retry-After 60, got %q", got)
+	}
+	if len(limiter.keys) != 1 || limiter.keys[0] != "192.0.2.1" {
+		t.Errorf("Expected limiter to be called with client IP, got %q", limiter.keys)
+	}
+}
+
+func TestRateLimiterCapacity(t *testing.T) {
+	l := newRateLimiter(1, 1)
+	l.max = 3
+	for _, key := range []string{"a", "b", "c"} {
+		l.Allow(key)
+	}
+	l.Allow("a") // Most recently seen, so b is evicted first
+	for _, key := range []string{"d", "e"} {
+		l.Allow(key)
+	}
+	if len(l.clients) != 3 || l.order.Len() != 3 {
+		t.Fatalf("Expected 3 clients, got %d", len(l.clients))
+	}
+	for _, key := range []string{"a", "d", "e"} {
+		if _, ok := l.clients[key]; !ok {
+			t.Errorf("Expected %s to be kept", key)
+		}
+	}
+	if l.Allow("a") {
+		t.Error("Expected a to still be limited")
+	}
+	if !l.Allow("b") {
+		t.Error("Expected evicted b to be allowed")
+	}
+}
+
+func TestRateLimitKey(t *testing.T) {
+	var tests = []struct {
+		ip  string
+		out string
+	}{
+		{"192.0.2.1", "192.0.2.1"},
+		{"2001:db8::1", "2001:db8::/64"},
+		{"2001:db8::ffff:1", "2001:db8::/64"},
+		{"2001:db8:0:1::1", "2001:db8:0:1::/64"},
+	}
+	for _, tt := range tests {
+		if got := rateLimitKey(net.ParseIP(tt.ip)); got != tt.out {
+			t.Errorf("Expected %s for %s, got %s", tt.out, tt.ip, got)
+		}
+	}
+}
+
+func TestRateLimitExempt(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	_, exempt, _ := net.ParseCIDR("192.0.2.0/24")
+	server := testServer()
+	server.RateLimit = 1
+	server.RateLimitBurst = 1
+	server.RateLimitExempt = []*net.IPNet{exempt}
+	handler := server.Handler()
+
+	var tests = []struct {
+		remoteAddr string
+		status     []int
+	}{
+		{"192.0.2.1:1337", []int{200, 200, 200}},
+		{"198.51.100.1:1337", []int{200, 429, 429}},
+	}
+	for _, tt := range tests {
+		for _, status := range tt.status {
+			r := httptest.NewRequest("GET", "/ip", nil)
+			r.RemoteAddr = tt.remoteAddr
+			w := httptest.NewRecorder()
+			handler.ServeHTTP(w, r)
+			if w.Code != status {
+				t.Errorf("Expected %d for %s, got %d", status, tt.remoteAddr, w.Code)
+			}
+			if status == 429 && w.Header().Get("Retry-After") != "60" {
+				t.Errorf("Expected Retry-After %s, got %s", "60", w.Header().Get("Retry-After"))
+			}
+		}
+	}
+}
+
+func TestAccessLog(t *testing.T) {
+	now := time.Date(2018, 1, 2, 15, 4, 5, 0, time.UTC)
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(404)
+		w.Write([]byte("not found\n"))
+	})
+	var tests = []struct {
+		format    string
+		anonymize bool
+		out       string
+	}{
+		{LogFormatCLF, false, `127.0.0.1 - - [02/Jan/2018:15:04:05 +0000] "GET /foo?bar=baz HTTP/1.1" 404 10` + "\n"},
+		{LogFormatCLF, true, `127.0.0.0 - - [02/Jan/2018:15:04:05 +0000] "GET /foo?bar=baz HTTP/1.1" 404 10` + "\n"},
+		{LogFormatCombined, false, `127.0.0.1 - - [02/Jan/2018:15:04:05 +0000] "GET /foo?bar=baz HTTP/1.1" 404 10 "-" "curl/7.26.0"` + "\n"},
+		{LogFormatJSON, false, `{"time":"2018-01-02T15:04:05Z","remote_ip":"127.0.0.1","method":"GET","uri":"/foo?bar=baz","proto":"HTTP/1.1","status":404,"bytes":10,"user_agent":"curl/7.26.0","duration_ms":0}` + "\n"},
+	}
+	for _, tt := range tests {
+		var buf bytes.Buffer
+		l := &accessLog{w: &buf, format: tt.format, anonymize: tt.anonymize, now: func() time.Time { return now }}
+		r := httptest.NewRequest("GET", "/foo?bar=baz", nil)
+		r.RemoteAddr = "127.0.0.1:1337"
+		r.Header.Set("User-Agent", "curl/7.26.0")
+		l.handler(handler).ServeHTTP(httptest.NewRecorder(), r)
+		if got := buf.String(); got != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, got)
+		}
+	}
+
+	var buf bytes.Buffer
+	l := &accessLog{w: &buf, format: LogFormatJSON, now: func() time.Time { return now }}
+	r := httptest.NewRequest("GET", "/", nil)
+	r.TLS = &tls.ConnectionState{ServerName: "ifconfig.co"}
+	l.handler(handler).ServeHTTP(httptest.NewRecorder(), r)
+	if want := `"server_name":"ifconfig.co"`; !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected %s in %q", want, buf.String())
+	}
+
+	buf.Reset()
+	l = &accessLog{w: &buf, format: LogFormatCLF, now: func() time.Time { return now }}
+	r = httptest.NewRequest("GET", "/raw?api_key=secret&foo=bar", nil)
+	r.RemoteAddr = "127.0.0.1:1337"
+	l.handler(handler).ServeHTTP(httptest.NewRecorder(), r)
+	if want := `"GET /raw?api_key=REDACTED&foo=bar HTTP/1.1"`; !strings.Contains(buf.String(), want) {
+		t.Errorf("Expected %s in %q", want, buf.String())
+	}
+}
+
+func TestCountryFlag(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{"NO", "\U0001F1F3\U0001F1F4"},
+		{"us", "\U0001F1FA\U0001F1F8"},
+		{"", ""},
+		{"USA", ""},
+		{"1A", ""},
+	}
+	for _, tt := range tests {
+		if got := countryFlag(tt.in); got != tt.out {
+			t.Errorf("Expected %q for %q, got %q", tt.out, tt.in, got)
+		}
+	}
+}
+
+func TestIPFromRequest(t *testing.T) {
+	var tests = []struct {
+		remoteAddr    string
+		headerKey     string
+		headerValue   string
+		trustedHeader string
+		trustedHops   int
+		out           string
+	}{
+		{"127.0.0.1:9999", "", "", "", 0, "127.0.0.1"},                          // No header given
+		{"127.0.0.1:9999", "X-Real-IP", "1.3.3.7", "", 0, "127.0.0.1"},          // Trusted header is empty
+		{"127.0.0.1:9999", "X-Real-IP", "1.3.3.7", "X-Foo-Bar", 0, "127.0.0.1"}, // Trusted header does not match
+		{"127.0.0.1:9999", "X-Real-IP", "1.3.3.7", "X-Real-IP", 0, "1.3.3.7"},   // Trusted header matches
+		{"127.0.0.1:9999", "Forwarded", "for=1.3.3.7", "Forwarded", 0, "1.3.3.7"},
+		{"127.0.0.1:9999", "Forwarded", `For="1.3.3.7:4711";proto=https`, "Forwarded", 0, "1.3.3.7"},
+		{"127.0.0.1:9999", "Forwarded", `for="[2001:db8::17]:4711"`, "Forwarded", 0, "2001:db8::17"},
+		{"127.0.0.1:9999", "Forwarded", `for="[2001:db8::17]"`, "Forwarded", 0, "2001:db8::17"},
+		{"127.0.0.1:9999", "Forwarded", "for=192.0.2.1, for=1.3.3.7;by=203.0.113.1", "Forwarded", 0, "1.3.3.7"},
+		{"127.0.0.1:9999", "Forwarded", "for=192.0.2.1, for=1.3.3.7;by=203.0.113.1", "Forwarded", 1, "192.0.2.1"},
+		{"127.0.0.1:9999", "Forwarded", "proto=https", "Forwarded", 0, "127.0.0.1"},
+		{"127.0.0.1:9999", "CloudFront-Viewer-Address", "1.3.3.7:4711", "CloudFront-Viewer-Address", 0, "1.3.3.7"},
+		{"127.0.0.1:9999", "CloudFront-Viewer-Address", "2001:db8::17:4711", "CloudFront-Viewer-Address", 0, "2001:db8::17"},
+		{"127.0.0.1:9999", "X-Forwarded-For", "1.3.3.7", "X-Forwarded-For", 0, "1.3.3.7"},
+		{"127.0.0.1:9999", "X-Forwarded-For", "192.0.2.1, 1.3.3.7", "X-Forwarded-For", 0, "1.3.3.7"},
+		{"127.0.0.1:9999", "X-Forwarded-For", "192.0.2.1, 1.3.3.7, 203.0.113.1", "X-Forwarded-For", 1, "1.3.3.7"},
+		{"127.0.0.1:9999", "X-Forwarded-For", "192.0.2.1, 1.3.3.7, 203.0.113.1", "X-Forwarded-For", 2, "192.0.2.1"},
+		{"127.0.0.1:9999", "X-Forwarded-For", "1.3.3.7, 203.0.113.1", "X-Forwarded-For", 5, "1.3.3.7"}, // Fewer hops than trusted
+	}
+	for _, tt := range tests {
+		r := &http.Request{
+			RemoteAddr: tt.remoteAddr,
+			Header:     http.Header{},
+		}
+		r.Header.Add(tt.headerKey, tt.headerValue)
+		ip, viaProxy, err := ipFromRequest(tt.trustedHeader, tt.trustedHops, r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out := net.ParseIP(tt.out)
+		if !ip.Equal(out) {
+			t.Errorf("Expected %s, got %s", out, ip)
+		}
+		// All cases where the header is used give a different IP than the peer
+		if want := tt.out != "127.0.0.1"; viaProxy != want {
+			t.Errorf("Expected via proxy %t for %s: %s, got %t", want, tt.headerKey, tt.headerValue, viaProxy)
+		}
+	}
+}
+
+func TestTrustedProxy(t *testing.T) {
+	log.SetOutput(ioutil.Discard)
+	server := testServer()
+	server.IPHeader = "CF-Connecting-IP"
+	server.TrustedProxy = func(ip net.IP) bool { return ip.Equal(net.IPv4(192, 0, 2, 1)) }
+	handler := server.Handler()
+
+	var tests = []struct {
+		remoteAddr string
+		out        string
+	}{
+		{"192.0.2.1:1337", "1.3.3.7\n"},
+		{"192.0.2.2:1337", "192.0.2.2\n"},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/ip", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header.Set("CF-Connecting-IP", "1.3.3.7")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		if got := w.Body.String(); got != tt.out {
+			t.Errorf("Expected %q for %s, got %q", tt.out, tt.remoteAddr, got)
+		}
+	}
+}
+
+func TestForwardedChain(t *testing.T) {
+	var tests = []struct {
+		header http.Header
+		out    []string
+	}{
+		{http.Header{}, nil},
+		{http.Header{"X-Forwarded-For": {"192.0.2.1, 198.51.100.1", "2001:db8::1"}}, []string{"192.0.2.1", "198.51.100.1", "2001:db8::1"}},
+		{http.Header{"X-Forwarded-For": {"192.0.2.1, unknown"}}, []string{"192.0.2.1"}},
+		{http.Header{"Forwarded": {`for=192.0.2.1;proto=http, for="[2001:db8::1]:80"`}, "X-Forwarded-For": {"198.51.100.1"}},
+			[]string{"192.0.2.1", "2001:db8::1"}},
+	}
+	for _, tt := range tests {
+		chain := forwardedChain(&http.Request{Header: tt.header})
+		var out []string
+		for _, ip := range chain {
+			out = append(out, ip.String())
+		}
+		if strings.Join(out, ",") != strings.Join(tt.out, ",") {
+			t.Errorf("Expected %v for %v, got %v", tt.out, tt.header, out)
+		}
+	}
+}
+
+func TestTrustedForwardedChain(t *testing.T) {
+	_, trusted, _ := net.ParseCIDR("10.0.0.0/8")
+	var tests = []struct {
+		ipHeader     string
+		trustedProxy func(net.IP) bool
+		remoteAddr   string
+		out          string
+	}{
+		{"", nil, "10.0.0.1:1337", ""},
+		{"X-Real-IP", nil, "10.0.0.1:1337", ""},
+		{"X-Forwarded-For", nil, "10.0.0.1:1337", "198.51.100.1"}, // Only the trusted header
+		{"Forwarded", nil, "10.0.0.1:1337", "192.0.2.1"},
+		{"", trusted.Contains, "10.0.0.1:1337", "192.0.2.1"},
+		{"", trusted.Contains, "203.0.113.1:1337", ""},
+	}
+	for _, tt := range tests {
+		server := testServer()
+		server.IPHeader = tt.ipHeader
+		server.TrustedProxy = tt.trustedProxy
+		r := httptest.NewRequest("GET", "/json", nil)
+		r.RemoteAddr = tt.remoteAddr
+		r.Header.Set("Forwarded", "for=192.0.2.1")
+		r.Header.Set("X-Forwarded-For", "198.51.100.1")
+		var out []string
+		for _, ip := range server.trustedForwardedChain(r) {
+			out = append(out, ip.String())
+		}
+		if got := strings.Join(out, ","); got != tt.out {
+			t.Errorf("Expected %q with header %q from %s, got %q", tt.out, tt.ipHeader, tt.remoteAddr, got)
 		}
 	}
 }
@@ -0,0 +1,37 @@
+package http
+
+import "net/http"
+
+type InfoResponse struct {
+	Databases map[string]string `json:"databases"`
+	Features  map[string]bool   `json:"features"`
+}
+
+func (s *Server) newInfoResponse() InfoResponse {
+	geo := s.hasGeo()
+	return InfoResponse{
+		Databases: s.db.Types(),
+		Features: map[string]bool{
+			"geo":             geo,
+			"reverse_lookup":  s.LookupAddr != nil,
+			"verify_hostname": s.VerifyHostname && s.LookupAddr != nil && s.LookupHost != nil,
+			"resolve":         s.Resolve && s.LookupHost != nil,
+			"port_lookup":     s.LookupPort != nil,
+			"tor_exit":        s.TorExit != nil,
+			"bogon":           s.Bogon != nil,
+			"raw_lookup":      geo && s.RawLookup,
+			"batch":           geo && s.Batch,
+			"openapi":         s.OpenAPI,
+			"rate_limit":      s.RateLimit > 0 || s.RateLimiter != nil,
+		},
+	}
+}
+
+func (s *Server) InfoHandler(w http.ResponseWriter, r *http.Request) *appError {
+	b, err := s.marshalJSON(s.newInfoResponse())
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
@@ -0,0 +1,232 @@
+package http
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// writeJSON writes the JSON body b. If SigningKey is set, the HMAC-SHA256 of b is sent in the X-Signature header.
+func (s *Server) writeJSON(w http.ResponseWriter, b []byte) {
+	w.Header().Set("Content-Type", jsonContentType)
+	if len(s.SigningKey) > 0 {
+		w.Header().Set("X-Signature", "sha256="+sign(s.SigningKey, b))
+	}
+	w.Write(b)
+}
+
+func sign(key, b []byte) string {
+	mac := hmac.New(sha256.New, key)
+	mac.Write(b)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (s *Server) marshalJSON(v interface{}) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if s.CamelCase {
+		return rewriteKeys(b, camelCase)
+	}
+	return b, nil
+}
+
+func (s *Server) marshalIndentJSON(v interface{}) ([]byte, error) {
+	b, err := s.marshalJSON(v)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := json.Indent(&buf, b, "", "  "); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// extraResponse encodes v, which must encode to an object, with the fields of extra added to it. Fields of v take
+// precedence over fields of extra with the same name.
+type extraResponse struct {
+	v     interface{}
+	extra map[string]interface{}
+}
+
+func (e extraResponse) MarshalJSON() ([]byte, error) {
+	b, err := json.Marshal(e.v)
+	if err != nil {
+		return nil, err
+	}
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(b, &fields); err != nil {
+		return nil, err
+	}
+	extra := make(map[string]interface{}, len(e.extra))
+	for k, v := range e.extra {
+		if _, exists := fields[k]; !exists {
+			extra[k] = v
+		}
+	}
+	if len(extra) == 0 {
+		return b, nil
+	}
+	x, err := json.Marshal(extra)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.Write(b[:len(b)-1])
+	if len(fields) > 0 {
+		buf.WriteByte(',')
+	}
+	buf.Write(x[1:])
+	return buf.Bytes(), nil
+}
+
+// nullResponse encodes the struct v like encoding/json, but writes empty fields as null instead of omitting them.
+type nullResponse struct{ v interface{} }
+
+type jsonField struct {
+	name  string
+	value json.RawMessage
+}
+
+func (n nullResponse) MarshalJSON() ([]byte, error) {
+	fields, err := nullFields(reflect.ValueOf(n.v))
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, f := range fields {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		name, _ := json.Marshal(f.name)
+		buf.Write(name)
+		buf.WriteByte(':')
+		buf.Write(f.value)
+	}
+	buf.WriteByte('}')
+	return buf.Bytes(), nil
+}
+
+func nullFields(v reflect.Value) ([]jsonField, error) {
+	var fields []jsonField
+	for i := 0; i < v.NumField(); i++ {
+		f := v.Type().Field(i)
+		if f.Anonymous && f.Type.Kind() == reflect.Struct {
+			embedded, err := nullFields(v.Field(i))
+			if err != nil {
+				return nil, err
+			}
+			fields = append(fields, embedded...)
+			continue
+		}
+		tag := strings.Split(f.Tag.Get("json"), ",")
+		if tag[0] == "" || tag[0] == "-" {
+			continue
+		}
+		value := json.RawMessage("null")
+		if fv := v.Field(i); !fv.IsZero() || !strings.Contains(f.Tag.Get("json"), ",omitempty") {
+			b, err := json.Marshal(fv.Interface())
+			if err != nil {
+				return nil, err
+			}
+			if len(tag) > 1 && tag[len(tag)-1] == "string" {
+				b, _ = json.Marshal(string(b))
+			}
+			value = b
+		}
+		// Like encoding/json, a field in the outer struct replaces a field with the same name in an embedded one
+		for j := range fields {
+			if fields[j].name == tag[0] {
+				fields = append(fields[:j], fields[j+1:]...)
+				break
+			}
+		}
+		fields = append(fields, jsonField{name: tag[0], value: value})
+	}
+	return fields, nil
+}
+
+func camelCase(s string) string {
+	parts := strings.Split(s, "_")
+	for i := 1; i < len(parts); i++ {
+		if parts[i] != "" {
+			parts[i] = strings.ToUpper(parts[i][:1]) + parts[i][1:]
+		}
+	}
+	return strings.Join(parts, "")
+}
+
+// rewriteKeys applies fn to all object keys in the JSON document b, preserving the order of keys.
+func rewriteKeys(b []byte, fn func(string) string) ([]byte, error) {
+	type frame struct {
+		object bool
+		n      int // Number of keys and values written in objects, or values written in arrays
+	}
+	var stack []frame
+	var buf bytes.Buffer
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	for {
+		t, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		if d, ok := t.(json.Delim); ok && (d == '}' || d == ']') {
+			buf.WriteByte(byte(d))
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 {
+				stack[len(stack)-1].n++
+			}
+			continue
+		}
+		isKey := false
+		if len(stack) > 0 {
+			top := stack[len(stack)-1]
+			isKey = top.object && top.n%2 == 0
+			if top.n > 0 && (!top.object || isKey) {
+				buf.WriteByte(',')
+			}
+		}
+		switch v := t.(type) {
+		case json.Delim:
+			buf.WriteByte(byte(v))
+			stack = append(stack, frame{object: v == '{'})
+			continue
+		case string:
+			if isKey {
+				v = fn(v)
+			}
+			s, err := json.Marshal(v)
+			if err != nil {
+				return nil, err
+			}
+			buf.Write(s)
+		case json.Number:
+			buf.WriteString(v.String())
+		case bool:
+			buf.WriteString(strconv.FormatBool(v))
+		case nil:
+			buf.WriteString("null")
+		}
+		if isKey {
+			buf.WriteByte(':')
+		}
+		if len(stack) > 0 {
+			stack[len(stack)-1].n++
+		}
+	}
+	return buf.Bytes(), nil
+}
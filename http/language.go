@@ -0,0 +1,72 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// acceptLanguages returns the language tags of an Accept-Language header value, most preferred first.
+func acceptLanguages(value string) []string {
+	type language struct {
+		tag string
+		q   float64
+	}
+	var languages []language
+	for _, part := range strings.Split(value, ",") {
+		fields := strings.Split(part, ";")
+		tag := strings.TrimSpace(fields[0])
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		for _, param := range fields[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "q" {
+				if v, err := strconv.ParseFloat(kv[1], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if q > 0 {
+			languages = append(languages, language{tag, q})
+		}
+	}
+	sort.SliceStable(languages, func(i, j int) bool { return languages[i].q > languages[j].q })
+	tags := make([]string, len(languages))
+	for i, l := range languages {
+		tags[i] = l.tag
+	}
+	return tags
+}
+
+// localizedName returns the name in the first of languages present in names. A tag with a region, such as de-AT,
+// also matches its language.
+func localizedName(names map[string]string, languages []string) string {
+	for _, tag := range languages {
+		for _, t := range []string{tag, strings.SplitN(tag, "-", 2)[0]} {
+			for lang, name := range names {
+				if strings.EqualFold(lang, t) && name != "" {
+					return name
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// languages returns the languages to use for names in responses to r, or nil if names should be in English. Languages
+// accepted by the client take precedence over the default language of the host, if any.
+func (s *Server) languages(r *http.Request) []string {
+	languages := acceptLanguages(r.Header.Get("Accept-Language"))
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	if lang, ok := s.HostLanguages[host]; ok {
+		languages = append(languages, lang)
+	}
+	return languages
+}
@@ -0,0 +1,165 @@
+package http
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mpolden/ipd/iputil"
+)
+
+const (
+	LogFormatJSON     = "json"
+	LogFormatCLF      = "clf"
+	LogFormatCombined = "combined"
+)
+
+const clfTimeLayout = "02/Jan/2006:15:04:05 -0700"
+
+type accessLog struct {
+	mu        sync.Mutex
+	w         io.Writer
+	format    string
+	ipHeader  string
+	hops      int
+	anonymize bool
+	now       func() time.Time
+}
+
+type accessLogEntry struct {
+	Time       time.Time `json:"time"`
+	RemoteIP   string    `json:"remote_ip"`
+	Method     string    `json:"method"`
+	URI        string    `json:"uri"`
+	Proto      string    `json:"proto"`
+	Status     int       `json:"status"`
+	Bytes      int       `json:"bytes"`
+	Referer    string    `json:"referer,omitempty"`
+	UserAgent  string    `json:"user_agent,omitempty"`
+	DurationMs float64   `json:"duration_ms"`
+	ServerName string    `json:"server_name,omitempty"`
+}
+
+type loggingResponseWriter struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (w *loggingResponseWriter) WriteHeader(code int) {
+	if w.status == 0 {
+		w.status = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *loggingResponseWriter) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.size += n
+	return n, err
+}
+
+func (w *loggingResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (l *accessLog) remoteIP(r *http.Request) string {
+	ip, _, err := ipFromRequest(l.ipHeader, l.hops, r)
+	if err != nil {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			return r.RemoteAddr
+		}
+		if ip = net.ParseIP(host); ip == nil {
+			return host
+		}
+	}
+	if l.anonymize {
+		ip = iputil.Anonymize(ip)
+	}
+	return ip.String()
+}
+
+func (l *accessLog) write(e accessLogEntry) error {
+	var line []byte
+	switch l.format {
+	case LogFormatCLF, LogFormatCombined:
+		size := "-"
+		if e.Bytes > 0 {
+			size = strconv.Itoa(e.Bytes)
+		}
+		s := fmt.Sprintf("%s - - [%s] \"%s %s %s\" %d %s", e.RemoteIP, e.Time.Format(clfTimeLayout), e.Method,
+			e.URI, e.Proto, e.Status, size)
+		if l.format == LogFormatCombined {
+			s += fmt.Sprintf(" %q %q", orDash(e.Referer), orDash(e.UserAgent))
+		}
+		line = []byte(s)
+	default:
+		b, err := json.Marshal(e)
+		if err != nil {
+			return err
+		}
+		line = b
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	_, err := l.w.Write(append(line, '\n'))
+	return err
+}
+
+func (l *accessLog) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := l.now()
+		lw := &loggingResponseWriter{ResponseWriter: w}
+		next.ServeHTTP(lw, r)
+		if lw.status == 0 {
+			lw.status = http.StatusOK
+		}
+		l.write(accessLogEntry{
+			Time:       start,
+			RemoteIP:   l.remoteIP(r),
+			Method:     r.Method,
+			URI:        redactURI(r.RequestURI),
+			Proto:      r.Proto,
+			Status:     lw.status,
+			Bytes:      lw.size,
+			Referer:    r.Referer(),
+			UserAgent:  r.UserAgent(),
+			DurationMs: float64(l.now().Sub(start)) / float64(time.Millisecond),
+			ServerName: serverName(r),
+		})
+	})
+}
+
+// redactURI replaces the value of any api_key query parameter in uri, so that API keys are not written to the log.
+func redactURI(uri string) string {
+	i := strings.IndexByte(uri, '?')
+	if i < 0 {
+		return uri
+	}
+	params := strings.Split(uri[i+1:], "&")
+	for j, p := range params {
+		if name := strings.SplitN(p, "=", 2)[0]; name == "api_key" {
+			params[j] = name + "=REDACTED"
+		}
+	}
+	return uri[:i+1] + strings.Join(params, "&")
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,171 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"reflect"
+	"strings"
+)
+
+type apiOperation struct {
+	summary     string
+	contentType string
+	schema      interface{} // Value of the response type, or nil for plain text
+	parameters  []map[string]interface{}
+}
+
+var portParameter = map[string]interface{}{
+	"name": "port", "in": "path", "required": true,
+	"schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": 65535},
+}
+
+var apiOperations = map[string]apiOperation{
+	"/":             {summary: "IP address, JSON or HTML depending on client", contentType: jsonMediaType, schema: Response{}},
+	"/json":         {summary: "All information about the client", contentType: jsonMediaType, schema: Response{}},
+	"/json/pretty":  {summary: "All information about the client, indented", contentType: jsonMediaType, schema: Response{}},
+	"/whoami":       {summary: "IP address, user agent and request headers", contentType: jsonMediaType, schema: WhoamiResponse{}},
+	"/info":         {summary: "Enabled features and loaded databases", contentType: jsonMediaType, schema: InfoResponse{}},
+	"/formats":      {summary: "IP address in several representations", contentType: jsonMediaType, schema: FormatsResponse{}},
+	"/server":       {summary: "Hostname, addresses and location of the server", contentType: jsonMediaType, schema: ServerResponse{}},
+	"/events":       {summary: "IP address as server-sent events", contentType: eventStreamMediaType},
+	"/ip":           {summary: "IP address", contentType: textMediaType},
+	"/ip4":          {summary: "IPv4 address, if connecting over IPv4", contentType: textMediaType},
+	"/ip6":          {summary: "IPv6 address, if connecting over IPv6", contentType: textMediaType},
+	"/ip-decimal":   {summary: "IP address in decimal form", contentType: textMediaType},
+	"/all":          {summary: "All information about the client as lines of text", contentType: textMediaType},
+	"/bogon":        {summary: "Whether the IP address is in a bogon prefix", contentType: textMediaType},
+	"/country":      {summary: "Country name", contentType: textMediaType},
+	"/country-iso":  {summary: "Country ISO code", contentType: textMediaType},
+	"/country-flag": {summary: "Country flag emoji", contentType: textMediaType},
+	"/city":         {summary: "City name", contentType: textMediaType},
+	"/raw":          {summary: "Raw database records", contentType: jsonMediaType, schema: map[string]interface{}{}},
+	"/batch.csv":    {summary: "Append geo columns to CSV of IP addresses", contentType: "text/csv"},
+	"/speed/upload": {summary: "Size of uploaded body and time to receive it", contentType: jsonMediaType, schema: UploadResponse{}},
+	"/openapi.json": {summary: "This document", contentType: jsonMediaType, schema: map[string]interface{}{}},
+	"/distance": {summary: "Distance to a location", contentType: jsonMediaType, schema: DistanceResponse{},
+		parameters: []map[string]interface{}{{"name": "to", "in": "query", "required": true,
+			"description": "Latitude and longitude separated by comma", "schema": map[string]interface{}{"type": "string"}}}},
+	"/ports": {summary: "Test if multiple ports are reachable", contentType: jsonMediaType, schema: PortsResponse{},
+		parameters: []map[string]interface{}{{"name": "list", "in": "query", "required": true,
+			"description": "Ports or port ranges separated by comma", "schema": map[string]interface{}{"type": "string"}}}},
+	"/resolve/": {summary: "IP addresses of hostname", contentType: jsonMediaType, schema: ResolveResponse{},
+		parameters: []map[string]interface{}{{"name": "hostname", "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "string"}}}},
+	"/decimal/": {summary: "IP address of a number in decimal, or hexadecimal or octal with 0x or 0o prefix",
+		contentType: textMediaType, parameters: []map[string]interface{}{{"name": "number", "in": "path", "required": true,
+			"schema": map[string]interface{}{"type": "string"}}}},
+	"/speed": {summary: "Random bytes for measuring download speed", contentType: "application/octet-stream",
+		parameters: []map[string]interface{}{{"name": "bytes", "in": "query",
+			"schema": map[string]interface{}{"type": "integer", "minimum": 0, "maximum": maxSpeedBytes}}}},
+	"/port/": {summary: "Test if port is reachable", contentType: jsonMediaType, schema: PortResponse{},
+		parameters: []map[string]interface{}{portParameter}},
+	"/ping/": {summary: "Round-trip time to port", contentType: jsonMediaType, schema: PortResponse{},
+		parameters: []map[string]interface{}{portParameter, {"name": "attempts", "in": "query",
+			"schema": map[string]interface{}{"type": "integer", "minimum": 1, "maximum": maxPingAttempts}}}},
+}
+
+func (s *Server) jsonSchema(t reflect.Type) map[string]interface{} {
+	switch {
+	case t == reflect.TypeOf(net.IP{}):
+		return map[string]interface{}{"type": "string", "format": "ip"}
+	case t.Kind() == reflect.Ptr:
+		return s.jsonSchema(t.Elem())
+	case t.Kind() == reflect.Slice:
+		return map[string]interface{}{"type": "array", "items": s.jsonSchema(t.Elem())}
+	case t.Kind() == reflect.Map:
+		return map[string]interface{}{"type": "object"}
+	case t.Kind() == reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case t.Kind() == reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case t.Kind() == reflect.Float32 || t.Kind() == reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case t.Kind() >= reflect.Int && t.Kind() <= reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case t.Kind() == reflect.Struct:
+		properties := make(map[string]interface{})
+		var required []string
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			tag := strings.Split(f.Tag.Get("json"), ",")
+			if tag[0] == "" || tag[0] == "-" {
+				continue
+			}
+			schema := s.jsonSchema(f.Type)
+			if tag[0] == "ip_decimal" && s.DecimalString {
+				schema = map[string]interface{}{"type": "string"}
+			}
+			if tag[0] == "port" && s.PortString {
+				schema = map[string]interface{}{"type": "string"}
+			}
+			properties[tag[0]] = schema
+			if len(tag) < 2 || tag[1] != "omitempty" {
+				name := tag[0]
+				if s.CamelCase { // Property names are rewritten by marshalJSON, but values are not
+					name = camelCase(name)
+				}
+				required = append(required, name)
+			}
+		}
+		return map[string]interface{}{"type": "object", "properties": properties, "required": required}
+	}
+	return map[string]interface{}{}
+}
+
+func (s *Server) openAPIDocument() map[string]interface{} {
+	paths := make(map[string]interface{})
+	s.routesMu.RLock()
+	defer s.routesMu.RUnlock()
+	for _, route := range s.routes {
+		op, ok := apiOperations[route.path]
+		if !ok || (s.LookupPort == nil && isPortPath(route.path)) {
+			continue
+		}
+		path := route.path
+		for _, p := range op.parameters {
+			if route.prefix && p["in"] == "path" {
+				path += fmt.Sprintf("{%s}", p["name"])
+			}
+		}
+		content := map[string]interface{}{}
+		if op.schema != nil {
+			content["schema"] = s.jsonSchema(reflect.TypeOf(op.schema))
+		}
+		operation := map[string]interface{}{
+			"summary": op.summary,
+			"responses": map[string]interface{}{
+				"200": map[string]interface{}{
+					"description": "OK",
+					"content":     map[string]interface{}{op.contentType: content},
+				},
+			},
+		}
+		if op.parameters != nil {
+			operation["parameters"] = op.parameters
+		}
+		methods, ok := paths[path].(map[string]interface{})
+		if !ok {
+			methods = make(map[string]interface{})
+			paths[path] = methods
+		}
+		method := strings.ToLower(route.method)
+		if _, exists := methods[method]; !exists { // Root is registered multiple times with different matchers
+			methods[method] = operation
+		}
+	}
+	return map[string]interface{}{
+		"openapi": "3.0.3",
+		"info":    map[string]interface{}{"title": "ipd", "version": "1.0.0"},
+		"paths":   paths,
+	}
+}
+
+func (s *Server) OpenAPIHandler(w http.ResponseWriter, r *http.Request) *appError {
+	b, err := s.marshalJSON(s.openAPIDocument())
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
@@ -0,0 +1,58 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/mpolden/ipd/iputil"
+	"github.com/mpolden/ipd/iputil/database"
+)
+
+// GeoOverride replaces database lookups for clients in Network with a static record.
+type GeoOverride struct {
+	Network *net.IPNet
+	Record  database.Record
+}
+
+// ParseGeoOverride parses an override on the form CIDR=ISO,COUNTRY,CITY, e.g. 10.0.0.0/8=NO,Norway,Oslo. An IP without
+// prefix length is a single address.
+func ParseGeoOverride(s string) (GeoOverride, error) {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 {
+		return GeoOverride{}, fmt.Errorf("invalid override: %s: expected CIDR=ISO,COUNTRY,CITY", s)
+	}
+	networks, err := iputil.ParseNetworks([]string{strings.TrimSpace(kv[0])})
+	if err != nil {
+		return GeoOverride{}, err
+	}
+	fields := strings.Split(kv[1], ",")
+	if len(fields) != 3 {
+		return GeoOverride{}, fmt.Errorf("invalid override: %s: expected CIDR=ISO,COUNTRY,CITY", s)
+	}
+	for i := range fields {
+		fields[i] = strings.TrimSpace(fields[i])
+	}
+	return GeoOverride{
+		Network: networks[0],
+		Record: database.Record{
+			Country: database.Country{ISO: strings.ToUpper(fields[0]), Name: fields[1]},
+			City:    fields[2],
+		},
+	}, nil
+}
+
+// lookup returns the record of ip from the first matching GeoOverride, or from the database if none match.
+func (s *Server) lookup(ip net.IP) (database.Record, error) {
+	for _, o := range s.GeoOverrides {
+		if o.Network.Contains(ip) {
+			return o.Record, nil
+		}
+	}
+	return s.db.Lookup(ip)
+}
+
+// hasGeo returns whether geo information is available for at least some clients.
+func (s *Server) hasGeo() bool {
+	return !s.db.IsEmpty() || len(s.GeoOverrides) > 0
+}
@@ -0,0 +1,135 @@
+package http
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	maxPortsPerRequest = 32
+	maxPortConcurrency = 8
+)
+
+type PortsResponse struct {
+	IP     net.IP         `json:"ip"`
+	Open   []uint64       `json:"open"`
+	Closed []uint64       `json:"closed"`
+	Ports  []PortResponse `json:"ports"`
+}
+
+type stringPortsResponse struct {
+	PortsResponse
+	Ports []interface{} `json:"ports"`
+}
+
+func (s *Server) portsResponse(response PortsResponse) interface{} {
+	if !s.PortString {
+		return response
+	}
+	ports := make([]interface{}, len(response.Ports))
+	for i, p := range response.Ports {
+		ports[i] = s.portResponse(p)
+	}
+	return stringPortsResponse{PortsResponse: response, Ports: ports}
+}
+
+func parsePort(s string) (uint64, error) {
+	if hasNonASCIIDigit(s) {
+		return 0, fmt.Errorf("invalid port: %s: only digits 0-9 are allowed", s)
+	}
+	port, err := strconv.ParseUint(s, 10, 16)
+	if err != nil || port < 1 {
+		return 0, fmt.Errorf("invalid port: %s", s)
+	}
+	return port, nil
+}
+
+// parsePortList parses a comma-separated list of ports and port ranges, such as 22,80,8000-8005.
+func parsePortList(list string) ([]uint64, error) {
+	var ports []uint64
+	seen := make(map[uint64]bool)
+	for _, element := range strings.Split(list, ",") {
+		first, last := element, element
+		if i := strings.Index(element, "-"); i >= 0 {
+			first, last = element[:i], element[i+1:]
+		}
+		from, err := parsePort(first)
+		if err != nil {
+			return nil, err
+		}
+		to, err := parsePort(last)
+		if err != nil {
+			return nil, err
+		}
+		if from > to {
+			return nil, fmt.Errorf("invalid port range: %s", element)
+		}
+		for port := from; port <= to; port++ {
+			if seen[port] {
+				continue
+			}
+			if len(ports) == maxPortsPerRequest {
+				return nil, fmt.Errorf("too many ports: at most %d can be checked", maxPortsPerRequest)
+			}
+			seen[port] = true
+			ports = append(ports, port)
+		}
+	}
+	return ports, nil
+}
+
+// newPortsResponse tests ports of ip, with at most concurrency dials at once.
+func (s *Server) newPortsResponse(ip net.IP, ports []uint64, concurrency int) PortsResponse {
+	results := make([]PortResponse, len(ports))
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+	for i, port := range ports {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, port uint64) {
+			defer func() { <-sem; wg.Done() }()
+			err := s.LookupPort(ip, port)
+			results[i] = PortResponse{IP: ip, Port: port, Reachable: err == nil, Error: dialError(err)}
+		}(i, port)
+	}
+	wg.Wait()
+	response := PortsResponse{IP: ip, Open: []uint64{}, Closed: []uint64{}, Ports: results}
+	for _, r := range results {
+		if r.Reachable {
+			response.Open = append(response.Open, r.Port)
+		} else {
+			response.Closed = append(response.Closed, r.Port)
+		}
+	}
+	return response
+}
+
+func (s *Server) PortsHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ports, err := parsePortList(r.URL.Query().Get("list"))
+	if err != nil {
+		return badRequest(err).WithMessage(err.Error()).AsJSON()
+	}
+	ip, err := portTargetIP(r)
+	if err != nil {
+		return responseError(err).AsJSON()
+	}
+	concurrency := maxPortConcurrency
+	if len(ports) < concurrency {
+		concurrency = len(ports)
+	}
+	concurrency, release, err := s.acquireDials(ip, concurrency)
+	if err != nil {
+		return responseError(err).AsJSON()
+	}
+	defer release()
+	b, err := s.marshalJSON(s.portsResponse(s.newPortsResponse(ip, ports, concurrency)))
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
@@ -0,0 +1,135 @@
+package http
+
+import (
+	"container/list"
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxRateLimitClients = 100000
+	rateLimitPrefix6    = 64 // IPv6 clients are usually assigned a whole /64
+)
+
+var errRateLimited = errors.New("rate limit exceeded")
+
+// RateLimiter decides whether a client, identified by key, may make another request. Implementations can share
+// state between instances, e.g. through a database.
+type RateLimiter interface {
+	Allow(key string) bool
+}
+
+// rateLimiter is a RateLimiter keeping a token bucket per client in memory. When there are more than max clients,
+// the least recently seen client is forgotten.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rate    float64 // Tokens per second
+	burst   float64
+	max     int
+	clients map[string]*list.Element
+	order   *list.List // Buckets, most recently seen first
+	now     func() time.Time
+}
+
+type bucket struct {
+	key    string
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:    float64(perMinute) / 60,
+		burst:   float64(burst),
+		max:     maxRateLimitClients,
+		clients: make(map[string]*list.Element),
+		order:   list.New(),
+		now:     time.Now,
+	}
+}
+
+// NewRateLimiter returns a RateLimiter allowing perMinute requests per minute per client in memory, with bursts of up
+// to burst requests.
+func NewRateLimiter(perMinute, burst int) RateLimiter { return newRateLimiter(perMinute, burst) }
+
+func (l *rateLimiter) Allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := l.now()
+	var b *bucket
+	if e, ok := l.clients[key]; ok {
+		l.order.MoveToFront(e)
+		b = e.Value.(*bucket)
+	} else {
+		if len(l.clients) >= l.max {
+			oldest := l.order.Back()
+			l.order.Remove(oldest)
+			delete(l.clients, oldest.Value.(*bucket).key)
+		}
+		b = &bucket{key: key, tokens: l.burst, last: now}
+		l.clients[key] = l.order.PushFront(b)
+	}
+	b.tokens += now.Sub(b.last).Seconds() * l.rate
+	if b.tokens > l.burst {
+		b.tokens = l.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// rateLimitKey returns the key identifying the client with ip. IPv6 addresses are keyed by their /64, so that a client
+// cannot avoid limits by using a new address from its network for each request.
+func rateLimitKey(ip net.IP) string {
+	if ip.To4() != nil {
+		return ip.String()
+	}
+	return ip.Mask(net.CIDRMask(rateLimitPrefix6, 128)).String() + "/" + strconv.Itoa(rateLimitPrefix6)
+}
+
+func (s *Server) rateLimitExempt(ip net.IP) bool {
+	for _, n := range s.RateLimitExempt {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Server) rateLimitHandler(next http.Handler, limiter RateLimiter) http.Handler {
+	return s.rateLimited(func(w http.ResponseWriter, r *http.Request) *appError {
+		next.ServeHTTP(w, r)
+		return nil
+	}, limiter, s.RateLimit)
+}
+
+// rateLimited restricts next to the requests allowed by limiter, which allows perMinute requests per minute per client
+// (0 if unknown).
+func (s *Server) rateLimited(next appHandler, limiter RateLimiter, perMinute int) appHandler {
+	retryAfter := "60"
+	if perMinute > 0 {
+		retryAfter = strconv.Itoa(int(math.Ceil(60 / float64(perMinute))))
+	}
+	return func(w http.ResponseWriter, r *http.Request) *appError {
+		ip, _, err := ipFromRequest(s.IPHeader, s.TrustedHops, r)
+		if err == nil && !s.rateLimitExempt(ip) && !limiter.Allow(rateLimitKey(ip)) {
+			err := tooManyRequests(errRateLimited).WithHeader("Retry-After", retryAfter)
+			if r.Header.Get("accept") == jsonMediaType {
+				err = err.AsJSON()
+			}
+			return err
+		}
+		return next(w, r)
+	}
+}
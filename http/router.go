@@ -2,6 +2,7 @@ package http
 
 import (
 	"net/http"
+	"sort"
 	"strings"
 )
 
@@ -15,6 +16,7 @@ type route struct {
 	prefix      bool
 	handler     appHandler
 	matcherFunc func(*http.Request) bool
+	condition   string // Description of matcherFunc
 }
 
 func NewRouter() *router {
@@ -37,37 +39,104 @@ func (r *router) RoutePrefix(method, path string, handler appHandler) *route {
 	return route
 }
 
+func (r *router) Disable(paths ...string) {
+	var routes []*route
+	for _, route := range r.routes {
+		disabled := false
+		for _, p := range paths {
+			if strings.TrimSuffix(route.path, "/") == strings.TrimSuffix(p, "/") {
+				disabled = true
+				break
+			}
+		}
+		if !disabled {
+			routes = append(routes, route)
+		}
+	}
+	r.routes = routes
+}
+
 func (r *router) Handler() http.Handler {
-	return appHandler(func(w http.ResponseWriter, req *http.Request) *appError {
-		for _, route := range r.routes {
-			if route.match(req) {
-				return route.handler(w, req)
+	return appHandler(r.serve)
+}
+
+func (r *router) serve(w http.ResponseWriter, req *http.Request) *appError {
+	for _, route := range r.routes {
+		if route.match(req) {
+			if req.Method == "HEAD" {
+				w = &headResponseWriter{w}
 			}
+			return route.handler(w, req)
 		}
-		return NotFoundHandler(w, req)
-	})
+	}
+	if methods := r.allowedMethods(req); len(methods) > 0 {
+		err := methodNotAllowed(nil).WithHeader("Allow", strings.Join(methods, ", "))
+		if req.Header.Get("accept") == jsonMediaType {
+			err = err.AsJSON()
+		}
+		return err
+	}
+	return NotFoundHandler(w, req)
+}
+
+// allowedMethods returns the sorted methods of routes matching the path of req. HEAD is allowed wherever GET is.
+func (r *router) allowedMethods(req *http.Request) []string {
+	seen := make(map[string]bool)
+	var methods []string
+	for _, route := range r.routes {
+		if !route.matchPath(req) || (route.matcherFunc != nil && !route.matcherFunc(req)) || seen[route.method] {
+			continue
+		}
+		seen[route.method] = true
+		methods = append(methods, route.method)
+		if route.method == "GET" && !seen["HEAD"] {
+			seen["HEAD"] = true
+			methods = append(methods, "HEAD")
+		}
+	}
+	sort.Strings(methods)
+	return methods
 }
 
 func (r *route) Header(header, value string) {
 	r.MatcherFunc(func(req *http.Request) bool {
 		return req.Header.Get(header) == value
 	})
+	r.condition = header + ": " + value
 }
 
 func (r *route) MatcherFunc(f func(*http.Request) bool) {
 	r.matcherFunc = f
+	r.condition = ""
+}
+
+// headResponseWriter discards the body written by GET handlers serving HEAD requests.
+type headResponseWriter struct {
+	http.ResponseWriter
+}
+
+func (w *headResponseWriter) Write(b []byte) (int, error) { return len(b), nil }
+
+func (w *headResponseWriter) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
 }
 
 func (r *route) match(req *http.Request) bool {
-	if req.Method != r.method {
-		return false
+	method := req.Method
+	if method == "HEAD" {
+		method = "GET"
 	}
-	if r.prefix {
-		if !strings.HasPrefix(req.URL.Path, r.path) {
-			return false
-		}
-	} else if r.path != req.URL.Path {
+	if method != r.method || !r.matchPath(req) {
 		return false
 	}
 	return r.matcherFunc == nil || r.matcherFunc(req)
 }
+
+func (r *route) matchPath(req *http.Request) bool {
+	if r.prefix {
+		return strings.HasPrefix(req.URL.Path, r.path)
+	}
+	return r.path == req.URL.Path
+}
@@ -0,0 +1,29 @@
+package http
+
+import (
+	"net"
+	"net/http"
+)
+
+// ServerResponse describes the server answering the request, e.g. for clients debugging which anycast location they
+// reached.
+type ServerResponse struct {
+	Hostname string   `json:"hostname"`
+	IPs      []net.IP `json:"ips,omitempty"`
+	PoP      string   `json:"pop,omitempty"`
+	Region   string   `json:"region,omitempty"`
+}
+
+// ServerHandler returns ServerHostname with the addresses it resolves to, and the configured PoP and Region.
+func (s *Server) ServerHandler(w http.ResponseWriter, r *http.Request) *appError {
+	response := ServerResponse{Hostname: s.ServerHostname, PoP: s.PoP, Region: s.Region}
+	if s.LookupHost != nil {
+		response.IPs, _ = s.LookupHost(s.ServerHostname) // Addresses are omitted if resolving fails
+	}
+	b, err := s.marshalJSON(response)
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
@@ -0,0 +1,73 @@
+package http
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultSpeedBytes = 10 << 20
+	maxSpeedBytes     = 100 << 20
+)
+
+type UploadResponse struct {
+	Bytes    int64   `json:"bytes"`
+	Duration float64 `json:"duration_ms"`
+}
+
+// SpeedHandler sends the number of random bytes given by the bytes parameter, for measuring download speed.
+func (s *Server) SpeedHandler(w http.ResponseWriter, r *http.Request) *appError {
+	n := int64(defaultSpeedBytes)
+	if v := r.URL.Query().Get("bytes"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 || size > maxSpeedBytes {
+			return badRequest(err).WithMessage(fmt.Sprintf("Invalid size: %s (at most %d bytes)\n", v, maxSpeedBytes))
+		}
+		n = size
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	w.Header().Set("Cache-Control", "no-store")
+	if flusher, ok := w.(http.Flusher); ok {
+		flusher.Flush() // Random bytes do not compress, so bypass any compression by sending headers now
+	}
+	// Cryptographic randomness is not needed, only data that cannot be compressed along the way
+	io.CopyN(w, &contextReader{ctx: r.Context(), r: rand.New(rand.NewSource(time.Now().UnixNano()))}, n)
+	return nil
+}
+
+// contextReader is a reader failing once ctx is done, e.g. to stop streaming a response at the request deadline.
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c *contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
+
+// UploadHandler discards the request body and reports its size and how long it took to receive, for measuring upload
+// speed.
+func (s *Server) UploadHandler(w http.ResponseWriter, r *http.Request) *appError {
+	start := time.Now()
+	n, err := io.Copy(ioutil.Discard, http.MaxBytesReader(w, r.Body, maxSpeedBytes))
+	if err != nil {
+		return payloadTooLarge(err).WithMessage(fmt.Sprintf("Upload too large: at most %d bytes", maxSpeedBytes)).AsJSON()
+	}
+	response := UploadResponse{Bytes: n, Duration: float64(time.Since(start)) / float64(time.Millisecond)}
+	b, err := s.marshalJSON(response)
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
@@ -0,0 +1,41 @@
+package http
+
+import (
+	"net/http"
+	"strings"
+)
+
+var forwardedURLHeaders = []string{"X-Forwarded-Proto", "X-Forwarded-Host"}
+
+// firstHeaderValue returns the first element of the comma-separated header name, which is the one set by the proxy
+// closest to the client.
+func firstHeaderValue(r *http.Request, name string) string {
+	return strings.TrimSpace(strings.SplitN(r.Header.Get(name), ",", 2)[0])
+}
+
+// baseURL returns the scheme and host the client used to reach us. If ForwardedURL is set and the request comes from a
+// trusted proxy, these are read from the X-Forwarded-Proto and X-Forwarded-Host headers, when present and valid.
+func (s *Server) baseURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	host := r.Host
+	if s.ForwardedURL && s.trustedPeer(r) {
+		if proto := strings.ToLower(firstHeaderValue(r, "X-Forwarded-Proto")); proto == "http" || proto == "https" {
+			scheme = proto
+		}
+		if h := firstHeaderValue(r, "X-Forwarded-Host"); h != "" && !strings.ContainsAny(h, "/\\?#@ ") {
+			host = h
+		}
+	}
+	return scheme + "://" + host
+}
+
+// AbsoluteURL returns the absolute URL of path, as seen by the client making request r.
+func (s *Server) AbsoluteURL(r *http.Request, path string) string {
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	return s.baseURL(r) + path
+}
@@ -0,0 +1,66 @@
+package http
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/mpolden/ipd/useragent"
+)
+
+const redacted = "[redacted]"
+
+// sensitiveHeaders are headers whose values are never echoed back, as they may contain credentials. The header
+// configured in Server.APIKeyHeader is also redacted.
+var sensitiveHeaders = map[string]bool{
+	"Authorization":       true,
+	"Cookie":              true,
+	"Proxy-Authorization": true,
+	"X-Api-Key":           true,
+	"X-Auth-Token":        true,
+	"X-Csrf-Token":        true,
+}
+
+type UserAgentResponse struct {
+	Product  string `json:"product,omitempty"`
+	Version  string `json:"version,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+	RawValue string `json:"raw_value"`
+}
+
+type WhoamiResponse struct {
+	IP        net.IP             `json:"ip"`
+	UserAgent *UserAgentResponse `json:"user_agent,omitempty"`
+	Headers   map[string]string  `json:"headers"`
+}
+
+func (s *Server) newWhoamiResponse(ip net.IP, r *http.Request) WhoamiResponse {
+	response := WhoamiResponse{IP: ip, Headers: make(map[string]string)}
+	if v := r.UserAgent(); v != "" {
+		ua := useragent.Parse(v)
+		response.UserAgent = &UserAgentResponse{Product: ua.Product, Version: ua.Version, Comment: ua.Comment,
+			RawValue: v}
+	}
+	apiKeyHeader := http.CanonicalHeaderKey(s.apiKeyHeader())
+	for name, values := range r.Header {
+		if sensitiveHeaders[name] || name == apiKeyHeader {
+			response.Headers[name] = redacted
+			continue
+		}
+		response.Headers[name] = strings.Join(values, ", ")
+	}
+	return response
+}
+
+func (s *Server) WhoamiHandler(w http.ResponseWriter, r *http.Request) *appError {
+	ip, err := s.clientIP(r)
+	if err != nil {
+		return responseError(err).AsJSON()
+	}
+	b, err := s.marshalJSON(s.newWhoamiResponse(ip, r))
+	if err != nil {
+		return internalServerError(err).AsJSON()
+	}
+	s.writeJSON(w, b)
+	return nil
+}
@@ -0,0 +1,104 @@
+package bogon
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// DefaultPrefixes contains the IPv4 and IPv6 prefixes that should never be seen on the public internet.
+var DefaultPrefixes = []string{
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.0.2.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"198.51.100.0/24",
+	"203.0.113.0/24",
+	"224.0.0.0/4",
+	"240.0.0.0/4",
+	"::/128",
+	"::1/128",
+	"100::/64",
+	"2001:10::/28",
+	"2001:db8::/32",
+	"3ffe::/16",
+	"5f00::/8",
+	"fc00::/7",
+	"fe80::/10",
+	"fec0::/10",
+	"ff00::/8",
+}
+
+type List struct {
+	mu       sync.RWMutex
+	networks []*net.IPNet
+}
+
+// New returns a list containing DefaultPrefixes.
+func New() *List {
+	l := &List{}
+	if err := l.Load(strings.NewReader(strings.Join(DefaultPrefixes, "\n"))); err != nil {
+		panic(err)
+	}
+	return l
+}
+
+func (l *List) Contains(ip net.IP) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for _, n := range l.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.networks)
+}
+
+// Load replaces the prefixes in l with those read from r, one per line. Empty lines and lines starting with # are
+// ignored.
+func (l *List) Load(r io.Reader) error {
+	var networks []*net.IPNet
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		_, n, err := net.ParseCIDR(line)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, n)
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.networks = networks
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *List) LoadFile(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return l.Load(f)
+}
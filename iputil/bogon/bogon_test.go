@@ -0,0 +1,50 @@
+package bogon
+
+import (
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestContains(t *testing.T) {
+	l := New()
+	var tests = []struct {
+		in  string
+		out bool
+	}{
+		{"10.1.2.3", true},
+		{"100.64.0.1", true},
+		{"127.0.0.1", true},
+		{"192.0.2.1", true},
+		{"255.255.255.255", true},
+		{"8.8.8.8", false},
+		{"::1", true},
+		{"2001:db8::1", true},
+		{"fe80::1", true},
+		{"2a00:1450::1", false},
+	}
+	for _, tt := range tests {
+		if got := l.Contains(net.ParseIP(tt.in)); got != tt.out {
+			t.Errorf("Expected %t, got %t for IP %s", tt.out, got, tt.in)
+		}
+	}
+}
+
+func TestLoad(t *testing.T) {
+	l := New()
+	if err := l.Load(strings.NewReader("# comment\n8.8.8.0/24\n\n")); err != nil {
+		t.Fatal(err)
+	}
+	if got := l.Len(); got != 1 {
+		t.Errorf("Expected 1 prefix, got %d", got)
+	}
+	if !l.Contains(net.ParseIP("8.8.8.8")) || l.Contains(net.ParseIP("10.0.0.1")) {
+		t.Error("Expected loaded prefixes to replace defaults")
+	}
+	if err := l.Load(strings.NewReader("foo\n")); err == nil {
+		t.Error("Expected error for invalid prefix")
+	}
+	if got := l.Len(); got != 1 {
+		t.Errorf("Expected prefixes to be unchanged after failed load, got %d", got)
+	}
+}
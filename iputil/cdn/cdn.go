@@ -0,0 +1,171 @@
+package cdn
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Provider describes how a CDN vendor passes on the client IP and where its IP ranges are published.
+type Provider struct {
+	Header string
+	URLs   []string
+	parse  func(io.Reader) ([]*net.IPNet, error)
+}
+
+var Providers = map[string]Provider{
+	"cloudflare": {
+		Header: "CF-Connecting-IP",
+		URLs:   []string{"https://www.cloudflare.com/ips-v4", "https://www.cloudflare.com/ips-v6"},
+		parse:  parseList,
+	},
+	"fastly": {
+		Header: "Fastly-Client-IP",
+		URLs:   []string{"https://api.fastly.com/public-ip-list"},
+		parse:  parseFastly,
+	},
+	"cloudfront": {
+		Header: "CloudFront-Viewer-Address",
+		URLs:   []string{"https://ip-ranges.amazonaws.com/ip-ranges.json"},
+		parse:  parseAWS,
+	},
+}
+
+type Ranges struct {
+	Provider
+	client   *http.Client
+	mu       sync.RWMutex
+	networks []*net.IPNet
+}
+
+func New(name string) (*Ranges, error) {
+	p, ok := Providers[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown CDN: %s", name)
+	}
+	return &Ranges{Provider: p, client: &http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (r *Ranges) Contains(ip net.IP) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	for _, n := range r.networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Ranges) Len() int {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return len(r.networks)
+}
+
+func (r *Ranges) Refresh() error {
+	var networks []*net.IPNet
+	for _, url := range r.URLs {
+		n, err := r.fetch(url)
+		if err != nil {
+			return err
+		}
+		networks = append(networks, n...)
+	}
+	r.mu.Lock()
+	r.networks = networks
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *Ranges) Watch(interval time.Duration, onError func(error)) {
+	for {
+		if err := r.Refresh(); err != nil && onError != nil {
+			onError(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func (r *Ranges) fetch(url string) ([]*net.IPNet, error) {
+	res, err := r.client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: unexpected status %d", url, res.StatusCode)
+	}
+	return r.parse(res.Body)
+}
+
+func parseCIDRs(cidrs []string) ([]*net.IPNet, error) {
+	networks := make([]*net.IPNet, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		_, n, err := net.ParseCIDR(cidr)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
+
+func parseList(r io.Reader) ([]*net.IPNet, error) {
+	var cidrs []string
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			cidrs = append(cidrs, line)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseCIDRs(cidrs)
+}
+
+func parseFastly(r io.Reader) ([]*net.IPNet, error) {
+	var list struct {
+		Addresses     []string `json:"addresses"`
+		IPv6Addresses []string `json:"ipv6_addresses"`
+	}
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, err
+	}
+	return parseCIDRs(append(list.Addresses, list.IPv6Addresses...))
+}
+
+func parseAWS(r io.Reader) ([]*net.IPNet, error) {
+	var list struct {
+		Prefixes []struct {
+			IPPrefix string `json:"ip_prefix"`
+			Service  string `json:"service"`
+		} `json:"prefixes"`
+		IPv6Prefixes []struct {
+			IPv6Prefix string `json:"ipv6_prefix"`
+			Service    string `json:"service"`
+		} `json:"ipv6_prefixes"`
+	}
+	if err := json.NewDecoder(r).Decode(&list); err != nil {
+		return nil, err
+	}
+	var cidrs []string
+	for _, p := range list.Prefixes {
+		if p.Service == "CLOUDFRONT" {
+			cidrs = append(cidrs, p.IPPrefix)
+		}
+	}
+	for _, p := range list.IPv6Prefixes {
+		if p.Service == "CLOUDFRONT" {
+			cidrs = append(cidrs, p.IPv6Prefix)
+		}
+	}
+	return parseCIDRs(cidrs)
+}
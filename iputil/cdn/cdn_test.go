@@ -0,0 +1,53 @@
+package cdn
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRefresh(t *testing.T) {
+	bodies := map[string]string{
+		"/cloudflare": "192.0.2.0/24\n2001:db8::/32\n",
+		"/fastly":     `{"addresses":["192.0.2.0/24"],"ipv6_addresses":["2001:db8::/32"]}`,
+		"/cloudfront": `{"prefixes":[{"ip_prefix":"192.0.2.0/24","service":"CLOUDFRONT"},{"ip_prefix":"198.51.100.0/24","service":"EC2"}],` +
+			`"ipv6_prefixes":[{"ipv6_prefix":"2001:db8::/32","service":"CLOUDFRONT"}]}`,
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, bodies[r.URL.Path])
+	}))
+	defer s.Close()
+
+	for name := range Providers {
+		r, err := New(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r.URLs = []string{s.URL + "/" + name}
+		if err := r.Refresh(); err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if got := r.Len(); got != 2 {
+			t.Errorf("Expected 2 networks for %s, got %d", name, got)
+		}
+		var tests = []struct {
+			in  string
+			out bool
+		}{
+			{"192.0.2.1", true},
+			{"2001:db8::1", true},
+			{"198.51.100.1", false},
+		}
+		for _, tt := range tests {
+			if got := r.Contains(net.ParseIP(tt.in)); got != tt.out {
+				t.Errorf("Expected %t, got %t for IP %s and %s", tt.out, got, tt.in, name)
+			}
+		}
+	}
+
+	if _, err := New("foo"); err == nil {
+		t.Error("Expected error for unknown CDN")
+	}
+}
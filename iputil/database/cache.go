@@ -0,0 +1,89 @@
+package database
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+)
+
+// Cache is a client caching the records returned by Lookup of an underlying client. Records are keyed by the
+// network of the IP with the configured prefix length, so that all IPs in e.g. the same /24 share a cache entry.
+//
+// Prefix lengths shorter than those of the database trade correctness for hit rate: when a network of the key
+// size contains ranges with different records, e.g. two cities, every IP in it gets the record of the first IP
+// looked up. Use the full length (32 and 128) to cache per IP.
+type Cache struct {
+	mu      sync.Mutex
+	client  Client
+	size    int
+	prefix4 int
+	prefix6 int
+	records map[string]Record
+}
+
+// NewCache returns a Cache holding up to size records of client, keyed by networks with prefix length prefix4 for
+// IPv4 and prefix6 for IPv6.
+func NewCache(client Client, size, prefix4, prefix6 int) (*Cache, error) {
+	if size < 1 {
+		return nil, fmt.Errorf("invalid cache size: %d", size)
+	}
+	if prefix4 < 0 || prefix4 > 32 {
+		return nil, fmt.Errorf("invalid IPv4 prefix length: %d", prefix4)
+	}
+	if prefix6 < 0 || prefix6 > 128 {
+		return nil, fmt.Errorf("invalid IPv6 prefix length: %d", prefix6)
+	}
+	return &Cache{client: client, size: size, prefix4: prefix4, prefix6: prefix6, records: make(map[string]Record)}, nil
+}
+
+func (c *Cache) key(ip net.IP) string {
+	if ip4 := ip.To4(); ip4 != nil {
+		return string(ip4.Mask(net.CIDRMask(c.prefix4, 32)))
+	}
+	return string(ip.Mask(net.CIDRMask(c.prefix6, 128)))
+}
+
+func (c *Cache) Lookup(ip net.IP) (Record, error) {
+	key := c.key(ip)
+	c.mu.Lock()
+	record, ok := c.records[key]
+	c.mu.Unlock()
+	if ok {
+		return record, nil
+	}
+	record, err := c.client.Lookup(ip)
+	if err != nil {
+		return Record{}, err // Errors are not cached
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.records) >= c.size {
+		for k := range c.records { // Evict an arbitrary record
+			delete(c.records, k)
+			break
+		}
+	}
+	c.records[key] = record
+	return record, nil
+}
+
+func (c *Cache) Country(ip net.IP) (Country, error)       { return c.client.Country(ip) }
+func (c *Cache) City(ip net.IP) (string, error)           { return c.client.City(ip) }
+func (c *Cache) ISP(ip net.IP) (ISP, error)               { return c.client.ISP(ip) }
+func (c *Cache) Location(ip net.IP) (Location, error)     { return c.client.Location(ip) }
+func (c *Cache) Confidence(ip net.IP) (Confidence, error) { return c.client.Confidence(ip) }
+
+func (c *Cache) Raw(ip net.IP) (map[string]interface{}, error) { return c.client.Raw(ip) }
+
+func (c *Cache) Types() map[string]string { return c.client.Types() }
+
+func (c *Cache) IsEmpty() bool { return c.client.IsEmpty() }
+
+// Close closes the underlying client, if it can be closed.
+func (c *Cache) Close() error {
+	if closer, ok := c.client.(io.Closer); ok {
+		return closer.Close()
+	}
+	return nil
+}
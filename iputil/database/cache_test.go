@@ -0,0 +1,86 @@
+package database
+
+import (
+	"net"
+	"testing"
+)
+
+type countingClient struct {
+	testClient
+	lookups int
+}
+
+func (c *countingClient) Lookup(ip net.IP) (Record, error) {
+	c.lookups++
+	return Record{City: ip.String()}, nil
+}
+
+func TestCache(t *testing.T) {
+	var tests = []struct {
+		prefix4, prefix6 int
+		ip               string
+		city             string
+		lookups          int
+	}{
+		{32, 128, "192.0.2.1", "192.0.2.1", 1},
+		{32, 128, "192.0.2.1", "192.0.2.1", 1},
+		{32, 128, "192.0.2.2", "192.0.2.2", 2},
+		{24, 48, "192.0.2.1", "192.0.2.1", 1},
+		{24, 48, "192.0.2.2", "192.0.2.1", 1}, // Same /24, record of first IP
+		{24, 48, "198.51.100.1", "198.51.100.1", 2},
+		{24, 48, "2001:db8::1", "2001:db8::1", 3},
+		{24, 48, "2001:db8:0:1::1", "2001:db8::1", 3},
+		{24, 48, "2001:db8:1::1", "2001:db8:1::1", 4},
+	}
+	var c *Cache
+	var client *countingClient
+	for i, tt := range tests {
+		if c == nil || c.prefix4 != tt.prefix4 {
+			client = &countingClient{}
+			var err error
+			if c, err = NewCache(client, 10, tt.prefix4, tt.prefix6); err != nil {
+				t.Fatal(err)
+			}
+		}
+		record, err := c.Lookup(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.City != tt.city {
+			t.Errorf("#%d: Expected record of %s, got %s", i, tt.city, record.City)
+		}
+		if client.lookups != tt.lookups {
+			t.Errorf("#%d: Expected %d lookups, got %d", i, tt.lookups, client.lookups)
+		}
+	}
+}
+
+func TestCacheEviction(t *testing.T) {
+	client := &countingClient{}
+	c, err := NewCache(client, 2, 32, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, ip := range []string{"192.0.2.1", "192.0.2.2", "192.0.2.3"} {
+		if _, err := c.Lookup(net.ParseIP(ip)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(c.records) != 2 {
+		t.Errorf("Expected 2 cached records, got %d", len(c.records))
+	}
+}
+
+func TestNewCacheInvalid(t *testing.T) {
+	var tests = []struct{ size, prefix4, prefix6 int }{
+		{0, 24, 48},
+		{10, 33, 48},
+		{10, 24, 129},
+		{10, -1, 48},
+	}
+	for _, tt := range tests {
+		if _, err := NewCache(&testClient{}, tt.size, tt.prefix4, tt.prefix6); err == nil {
+			t.Errorf("Expected error for size=%d prefix4=%d prefix6=%d", tt.size, tt.prefix4, tt.prefix6)
+		}
+	}
+}
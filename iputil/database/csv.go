@@ -0,0 +1,188 @@
+package database
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sort"
+)
+
+// ipRange is a range of IPs, inclusive, with the country and city of all IPs in it.
+type ipRange struct {
+	start, end [16]byte
+	country    string
+	city       string
+}
+
+// intervalTree is an augmented interval tree stored as a sorted array: the root of ranges[lo:hi] is the middle element,
+// and maxEnd holds the largest end of each subtree.
+type intervalTree struct {
+	ranges []ipRange
+	maxEnd [][16]byte
+}
+
+func newIntervalTree(ranges []ipRange) *intervalTree {
+	sort.Slice(ranges, func(i, j int) bool { return bytes.Compare(ranges[i].start[:], ranges[j].start[:]) < 0 })
+	t := &intervalTree{ranges: ranges, maxEnd: make([][16]byte, len(ranges))}
+	t.build(0, len(ranges))
+	return t
+}
+
+func (t *intervalTree) build(lo, hi int) [16]byte {
+	mid := (lo + hi) / 2
+	max := t.ranges[mid].end
+	if lo < mid {
+		if end := t.build(lo, mid); bytes.Compare(end[:], max[:]) > 0 {
+			max = end
+		}
+	}
+	if mid+1 < hi {
+		if end := t.build(mid+1, hi); bytes.Compare(end[:], max[:]) > 0 {
+			max = end
+		}
+	}
+	t.maxEnd[mid] = max
+	return max
+}
+
+// find returns the narrowest range containing ip, or nil if there is none.
+func (t *intervalTree) find(ip [16]byte) *ipRange {
+	var best *ipRange
+	t.search(0, len(t.ranges), ip, &best)
+	return best
+}
+
+func (t *intervalTree) search(lo, hi int, ip [16]byte, best **ipRange) {
+	if lo >= hi {
+		return
+	}
+	mid := (lo + hi) / 2
+	if bytes.Compare(t.maxEnd[mid][:], ip[:]) < 0 {
+		return // All ranges in this subtree end before ip
+	}
+	t.search(lo, mid, ip, best)
+	r := &t.ranges[mid]
+	if bytes.Compare(r.start[:], ip[:]) > 0 {
+		return // This range and all ranges to the right start after ip
+	}
+	if bytes.Compare(r.end[:], ip[:]) >= 0 && (*best == nil || r.narrower(*best)) {
+		*best = r
+	}
+	t.search(mid+1, hi, ip, best)
+}
+
+// narrower returns whether r is a narrower range than other. Ranges containing the same IP are either nested or
+// overlapping, so the range starting last is the most specific.
+func (r *ipRange) narrower(other *ipRange) bool {
+	if c := bytes.Compare(r.start[:], other.start[:]); c != 0 {
+		return c > 0
+	}
+	return bytes.Compare(r.end[:], other.end[:]) < 0
+}
+
+type csvDB struct {
+	tree *intervalTree
+}
+
+// NewCSV returns a client answering country and city lookups from the CSV file at path, where each row is an IP
+// range on the form start_ip,end_ip,country,city. A header row is ignored.
+func NewCSV(path string) (Client, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	c, err := ReadCSV(f)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return c, nil
+}
+
+// ReadCSV returns a client answering lookups from the CSV read from r, like NewCSV.
+func ReadCSV(r io.Reader) (Client, error) {
+	reader := csv.NewReader(r)
+	reader.FieldsPerRecord = 4
+	reader.ReuseRecord = true
+	var ranges []ipRange
+	for line := 1; ; line++ {
+		record, err := reader.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		start, end := net.ParseIP(record[0]), net.ParseIP(record[1])
+		if line == 1 && start == nil { // Treat first row as header
+			continue
+		}
+		if start == nil || end == nil || (start.To4() == nil) != (end.To4() == nil) {
+			return nil, fmt.Errorf("line %d: invalid IP range %s-%s", line, record[0], record[1])
+		}
+		rng := ipRange{country: record[2], city: record[3]}
+		copy(rng.start[:], start.To16())
+		copy(rng.end[:], end.To16())
+		if bytes.Compare(rng.start[:], rng.end[:]) > 0 {
+			return nil, fmt.Errorf("line %d: invalid IP range %s-%s", line, record[0], record[1])
+		}
+		ranges = append(ranges, rng)
+	}
+	if len(ranges) == 0 {
+		return &csvDB{}, nil
+	}
+	return &csvDB{tree: newIntervalTree(ranges)}, nil
+}
+
+func (c *csvDB) find(ip net.IP) *ipRange {
+	if c.tree == nil {
+		return nil
+	}
+	ip16 := ip.To16()
+	if ip16 == nil {
+		return nil
+	}
+	var key [16]byte
+	copy(key[:], ip16)
+	return c.tree.find(key)
+}
+
+func (c *csvDB) Country(ip net.IP) (Country, error) {
+	if r := c.find(ip); r != nil {
+		return Country{Name: r.country}, nil
+	}
+	return Country{}, nil
+}
+
+func (c *csvDB) City(ip net.IP) (string, error) {
+	if r := c.find(ip); r != nil {
+		return r.city, nil
+	}
+	return "", nil
+}
+
+func (c *csvDB) ISP(net.IP) (ISP, error)               { return ISP{}, nil }
+func (c *csvDB) Location(net.IP) (Location, error)     { return Location{}, nil }
+func (c *csvDB) Confidence(net.IP) (Confidence, error) { return Confidence{}, nil }
+
+func (c *csvDB) Lookup(ip net.IP) (Record, error) {
+	if r := c.find(ip); r != nil {
+		return Record{Country: Country{Name: r.country}, City: r.city}, nil
+	}
+	return Record{}, nil
+}
+
+func (c *csvDB) Raw(ip net.IP) (map[string]interface{}, error) {
+	var record interface{}
+	if r := c.find(ip); r != nil {
+		record = map[string]interface{}{"country": r.country, "city": r.city}
+	}
+	return map[string]interface{}{"csv": record}, nil
+}
+
+func (c *csvDB) Types() map[string]string { return map[string]string{"csv": "CSV"} }
+
+func (c *csvDB) IsEmpty() bool { return c.tree == nil }
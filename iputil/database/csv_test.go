@@ -0,0 +1,93 @@
+package database
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestCSV(t *testing.T) {
+	data := `start_ip,end_ip,country,city
+10.0.0.0,10.255.255.255,Elbonia,Bornyasherk
+10.1.0.0,10.1.255.255,Elbonia,Nanjasherk
+192.0.2.0,192.0.2.127,Norway,Oslo
+2001:db8::,2001:db8::ffff,Sweden,Stockholm
+`
+	c, err := ReadCSV(strings.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		ip      string
+		country string
+		city    string
+	}{
+		{"10.0.0.0", "Elbonia", "Bornyasherk"},
+		{"10.255.255.255", "Elbonia", "Bornyasherk"},
+		{"10.1.2.3", "Elbonia", "Nanjasherk"}, // Narrowest range wins
+		{"10.2.0.0", "Elbonia", "Bornyasherk"},
+		{"192.0.2.127", "Norway", "Oslo"},
+		{"192.0.2.128", "", ""},
+		{"11.0.0.0", "", ""},
+		{"2001:db8::1", "Sweden", "Stockholm"},
+		{"2001:db8::1:0", "", ""},
+		{"::ffff:192.0.2.1", "Norway", "Oslo"},
+	}
+	for _, tt := range tests {
+		record, err := c.Lookup(net.ParseIP(tt.ip))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if record.Country.Name != tt.country || record.City != tt.city {
+			t.Errorf("Expected %s, %s for %s, got %s, %s", tt.country, tt.city, tt.ip, record.Country.Name, record.City)
+		}
+	}
+	if c.IsEmpty() {
+		t.Error("Expected non-empty database")
+	}
+}
+
+func TestCSVInvalid(t *testing.T) {
+	var tests = []string{
+		"10.0.0.0,foo,Elbonia,Bornyasherk\n",
+		"10.0.0.1,10.0.0.0,Elbonia,Bornyasherk\n",
+		"10.0.0.0,2001:db8::,Elbonia,Bornyasherk\n",
+		"10.0.0.0,10.0.0.1,Elbonia\n",
+		"10.0.0.0,10.0.0.1,Elbonia,Bornyasherk\nfoo,bar,Elbonia,Bornyasherk\n",
+	}
+	for _, tt := range tests {
+		if _, err := ReadCSV(strings.NewReader(tt)); err == nil {
+			t.Errorf("Expected error for %q", tt)
+		}
+	}
+	c, err := ReadCSV(strings.NewReader("start_ip,end_ip,country,city\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.IsEmpty() {
+		t.Error("Expected empty database")
+	}
+}
+
+func BenchmarkCSVLookup(b *testing.B) {
+	const n = 1 << 18 // Consecutive /24 networks, as in a typical range file
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		start := make(net.IP, 4)
+		binary.BigEndian.PutUint32(start, uint32(i)<<8)
+		end := make(net.IP, 4)
+		binary.BigEndian.PutUint32(end, uint32(i)<<8|0xff)
+		fmt.Fprintf(&sb, "%s,%s,Country %d,City %d\n", start, end, i%200, i)
+	}
+	c, err := ReadCSV(strings.NewReader(sb.String()))
+	if err != nil {
+		b.Fatal(err)
+	}
+	ip := net.ParseIP("2.128.0.1")
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Lookup(ip)
+	}
+}
@@ -1,44 +1,113 @@
 package database
 
 import (
+	"math"
 	"net"
+	"sort"
+	"strings"
 
 	geoip2 "github.com/oschwald/geoip2-golang"
+	maxminddb "github.com/oschwald/maxminddb-golang"
 )
 
 type Client interface {
 	Country(net.IP) (Country, error)
 	City(net.IP) (string, error)
+	ISP(net.IP) (ISP, error)
+	Location(net.IP) (Location, error)
+	Confidence(net.IP) (Confidence, error)
+	Lookup(net.IP) (Record, error)
+	Raw(net.IP) (map[string]interface{}, error)
+	Types() map[string]string
 	IsEmpty() bool
 }
 
+// Record contains all information about an IP, as returned by Lookup. Country.Name and City are in English, names in
+// other languages are keyed by language in CountryNames and CityNames. HostingProvider is nil unless a database
+// knowing about hosting providers is loaded. Network is the network the ISP record applies to, if known.
+type Record struct {
+	Country         Country
+	City            string
+	ISP             ISP
+	Location        Location
+	Confidence      Confidence
+	CountryNames    map[string]string
+	CityNames       map[string]string
+	HostingProvider *bool
+	Network         *net.IPNet
+}
+
 type Country struct {
 	Name string
 	ISO  string
 }
 
+type Location struct {
+	Latitude  float64
+	Longitude float64
+}
+
+// Confidence holds the confidence, from 0 to 100, that the country and city of an IP is correct. Only available in
+// the Enterprise database.
+type Confidence struct {
+	Country uint8
+	City    uint8
+}
+
+type ISP struct {
+	ASN               uint   `maxminddb:"autonomous_system_number"`
+	ASNOrganization   string `maxminddb:"autonomous_system_organization"`
+	Name              string `maxminddb:"isp"`
+	Organization      string `maxminddb:"organization"`
+	ConnectionType    string `maxminddb:"connection_type"`
+	MobileCountryCode string `maxminddb:"mobile_country_code"`
+	MobileNetworkCode string `maxminddb:"mobile_network_code"`
+}
+
+// geoip is a client using MaxMind databases. Each database is opened once, and the reader is shared by the typed
+// lookups and by Raw.
 type geoip struct {
-	country *geoip2.Reader
-	city    *geoip2.Reader
+	country    *maxminddb.Reader
+	city       *maxminddb.Reader
+	isp        *maxminddb.Reader
+	enterprise *maxminddb.Reader
+	anonymous  *maxminddb.Reader
+	raw        map[string]*maxminddb.Reader
 }
 
-func New(countryDB, cityDB string) (Client, error) {
-	var country, city *geoip2.Reader
-	if countryDB != "" {
-		r, err := geoip2.Open(countryDB)
-		if err != nil {
-			return nil, err
+func New(countryDB, cityDB, ispDB, anonymousDB string) (Client, error) {
+	g := &geoip{raw: make(map[string]*maxminddb.Reader)}
+	for _, db := range []struct {
+		name   string
+		path   string
+		reader **maxminddb.Reader
+	}{
+		{"country", countryDB, &g.country},
+		{"city", cityDB, &g.city},
+		{"isp", ispDB, &g.isp},
+		{"anonymous", anonymousDB, &g.anonymous},
+	} {
+		if db.path == "" {
+			continue
 		}
-		country = r
-	}
-	if cityDB != "" {
-		r, err := geoip2.Open(cityDB)
+		r, err := maxminddb.Open(db.path)
 		if err != nil {
+			g.Close()
 			return nil, err
 		}
-		city = r
+		*db.reader = r
+		g.raw[db.name] = r
 	}
-	return &geoip{country: country, city: city}, nil
+	return g, nil
+}
+
+// NewEnterprise returns a client using a GeoIP2 Enterprise database for all lookups.
+func NewEnterprise(enterpriseDB string) (Client, error) {
+	r, err := maxminddb.Open(enterpriseDB)
+	if err != nil {
+		return nil, err
+	}
+	return &geoip{country: r, city: r, enterprise: r, raw: map[string]*maxminddb.Reader{"enterprise": r}}, nil
 }
 
 func (g *geoip) Country(ip net.IP) (Country, error) {
@@ -46,39 +115,217 @@ func (g *geoip) Country(ip net.IP) (Country, error) {
 	if g.country == nil {
 		return country, nil
 	}
-	record, err := g.country.Country(ip)
-	if err != nil {
+	var record geoip2.Country
+	if err := g.country.Lookup(ip, &record); err != nil {
 		return country, err
 	}
-	if c, exists := record.Country.Names["en"]; exists {
-		country.Name = c
+	return newCountry(record.Country.Names, record.Country.IsoCode, record.RegisteredCountry.Names,
+		record.RegisteredCountry.IsoCode), nil
+}
+
+// newCountry returns the country with given names and ISO code, falling back to the registered country.
+func newCountry(names map[string]string, iso string, registeredNames map[string]string, registeredISO string) Country {
+	country := Country{Name: names["en"], ISO: iso}
+	if country.Name == "" {
+		country.Name = registeredNames["en"]
 	}
-	if c, exists := record.RegisteredCountry.Names["en"]; exists && country.Name == "" {
-		country.Name = c
+	if country.ISO == "" {
+		country.ISO = registeredISO
 	}
-	if record.Country.IsoCode != "" {
-		country.ISO = record.Country.IsoCode
+	return country
+}
+
+// countryNames returns names, falling back to the names of the registered country like newCountry.
+func countryNames(names, registeredNames map[string]string) map[string]string {
+	if len(names) == 0 {
+		return registeredNames
 	}
-	if record.RegisteredCountry.IsoCode != "" && country.ISO == "" {
-		country.ISO = record.RegisteredCountry.IsoCode
+	return names
+}
+
+// LookupError is returned by Lookup when one or more databases fail, holding the error of each failed database keyed
+// by the kind of database. The record returned along with it contains the information of the other databases.
+type LookupError map[string]error
+
+func (e LookupError) Error() string {
+	names := make([]string, 0, len(e))
+	for name := range e {
+		names = append(names, name)
 	}
-	return country, nil
+	sort.Strings(names)
+	msgs := make([]string, len(names))
+	for i, name := range names {
+		msgs[i] = name + ": " + e[name].Error()
+	}
+	return "lookup failed: " + strings.Join(msgs, "; ")
+}
+
+// Lookup returns all information about ip, decoding each database record only once. A failing database does not
+// prevent lookups in the others: the information found is returned along with a LookupError.
+func (g *geoip) Lookup(ip net.IP) (Record, error) {
+	var record Record
+	errs := make(LookupError)
+	if g.enterprise != nil {
+		var e geoip2.Enterprise
+		network, ok, err := g.enterprise.LookupNetwork(ip, &e)
+		if err != nil {
+			errs["enterprise"] = err
+			return record, errs
+		}
+		record.Country = newCountry(e.Country.Names, e.Country.IsoCode, e.RegisteredCountry.Names,
+			e.RegisteredCountry.IsoCode)
+		record.CountryNames = countryNames(e.Country.Names, e.RegisteredCountry.Names)
+		hosting := e.Traits.UserType == "hosting"
+		record.HostingProvider = &hosting
+		record.City = e.City.Names["en"]
+		record.CityNames = e.City.Names
+		record.Location = Location{Latitude: e.Location.Latitude, Longitude: e.Location.Longitude}
+		record.Confidence = Confidence{Country: e.Country.Confidence, City: e.City.Confidence}
+		record.ISP = ISP{
+			ASN:             e.Traits.AutonomousSystemNumber,
+			ASNOrganization: e.Traits.AutonomousSystemOrganization,
+			Name:            e.Traits.ISP,
+			Organization:    e.Traits.Organization,
+			ConnectionType:  e.Traits.ConnectionType,
+		}
+		if ok {
+			record.Network = network
+		}
+		return record, nil
+	}
+	if g.country != nil {
+		var c geoip2.Country
+		if err := g.country.Lookup(ip, &c); err != nil {
+			errs["country"] = err
+		} else {
+			record.Country = newCountry(c.Country.Names, c.Country.IsoCode, c.RegisteredCountry.Names,
+				c.RegisteredCountry.IsoCode)
+			record.CountryNames = countryNames(c.Country.Names, c.RegisteredCountry.Names)
+		}
+	}
+	if g.city != nil {
+		var c geoip2.City
+		if err := g.city.Lookup(ip, &c); err != nil {
+			errs["city"] = err
+		} else {
+			record.City = c.City.Names["en"]
+			record.CityNames = c.City.Names
+			record.Location = Location{Latitude: c.Location.Latitude, Longitude: c.Location.Longitude}
+		}
+	}
+	if g.isp != nil {
+		if network, ok, err := g.isp.LookupNetwork(ip, &record.ISP); err != nil {
+			errs["isp"] = err
+		} else if ok {
+			record.Network = network
+		}
+	}
+	if g.anonymous != nil {
+		var a geoip2.AnonymousIP
+		if err := g.anonymous.Lookup(ip, &a); err != nil {
+			errs["anonymous"] = err
+		} else {
+			record.HostingProvider = &a.IsHostingProvider
+		}
+	}
+	if len(errs) > 0 {
+		return record, errs
+	}
+	return record, nil
 }
 
 func (g *geoip) City(ip net.IP) (string, error) {
 	if g.city == nil {
 		return "", nil
 	}
-	record, err := g.city.City(ip)
-	if err != nil {
+	var record geoip2.City
+	if err := g.city.Lookup(ip, &record); err != nil {
 		return "", err
 	}
-	if city, exists := record.City.Names["en"]; exists {
-		return city, nil
+	return record.City.Names["en"], nil
+}
+
+func (g *geoip) Location(ip net.IP) (Location, error) {
+	if g.city == nil {
+		return Location{}, nil
+	}
+	var record geoip2.City
+	if err := g.city.Lookup(ip, &record); err != nil {
+		return Location{}, err
+	}
+	return Location{Latitude: record.Location.Latitude, Longitude: record.Location.Longitude}, nil
+}
+
+// IsZero returns true if l is the zero location, which is what databases return for IPs without a known location.
+func (l Location) IsZero() bool {
+	return l.Latitude == 0 && l.Longitude == 0
+}
+
+// DistanceTo returns the great-circle distance in kilometers between l and other.
+func (l Location) DistanceTo(other Location) float64 {
+	const earthRadius = 6371.0
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat := rad(other.Latitude - l.Latitude)
+	dLon := rad(other.Longitude - l.Longitude)
+	a := math.Sin(dLat/2)*math.Sin(dLat/2) +
+		math.Cos(rad(l.Latitude))*math.Cos(rad(other.Latitude))*math.Sin(dLon/2)*math.Sin(dLon/2)
+	return 2 * earthRadius * math.Asin(math.Sqrt(a))
+}
+
+func (g *geoip) Confidence(ip net.IP) (Confidence, error) {
+	if g.enterprise == nil {
+		return Confidence{}, nil
+	}
+	var record geoip2.Enterprise
+	if err := g.enterprise.Lookup(ip, &record); err != nil {
+		return Confidence{}, err
+	}
+	return Confidence{Country: record.Country.Confidence, City: record.City.Confidence}, nil
+}
+
+func (g *geoip) ISP(ip net.IP) (ISP, error) {
+	isp := ISP{}
+	if g.enterprise != nil {
+		record, err := g.Lookup(ip)
+		return record.ISP, err
+	}
+	if g.isp == nil {
+		return isp, nil
+	}
+	err := g.isp.Lookup(ip, &isp)
+	return isp, err
+}
+
+func (g *geoip) Raw(ip net.IP) (map[string]interface{}, error) {
+	records := make(map[string]interface{})
+	for name, r := range g.raw {
+		var record interface{}
+		if err := r.Lookup(ip, &record); err != nil {
+			return nil, err
+		}
+		records[name] = record
+	}
+	return records, nil
+}
+
+// Types returns the database type of each open database, such as GeoLite2-City, keyed by the kind of database.
+func (g *geoip) Types() map[string]string {
+	types := make(map[string]string)
+	for name, r := range g.raw {
+		types[name] = r.Metadata.DatabaseType
+	}
+	return types
+}
+
+func (g *geoip) Close() error {
+	for _, r := range g.raw { // Every reader is in raw
+		if err := r.Close(); err != nil {
+			return err
+		}
 	}
-	return "", nil
+	return nil
 }
 
 func (g *geoip) IsEmpty() bool {
-	return g.country == nil && g.city == nil
+	return g.country == nil && g.city == nil && g.isp == nil && g.enterprise == nil
 }
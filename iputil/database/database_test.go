@@ -0,0 +1,49 @@
+package database
+
+import (
+	"errors"
+	"net"
+	"os"
+	"testing"
+)
+
+// Benchmarks use the databases given by IPD_COUNTRY_DB, IPD_CITY_DB and IPD_ISP_DB, and are skipped when unset
+func benchmarkClient(b *testing.B) Client {
+	countryDB, cityDB, ispDB := os.Getenv("IPD_COUNTRY_DB"), os.Getenv("IPD_CITY_DB"), os.Getenv("IPD_ISP_DB")
+	if countryDB == "" && cityDB == "" && ispDB == "" {
+		b.Skip("no databases given")
+	}
+	c, err := New(countryDB, cityDB, ispDB, "")
+	if err != nil {
+		b.Fatal(err)
+	}
+	return c
+}
+
+var benchmarkIP = net.ParseIP("8.8.8.8")
+
+func BenchmarkSeparateLookups(b *testing.B) {
+	c := benchmarkClient(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Country(benchmarkIP)
+		c.City(benchmarkIP)
+		c.ISP(benchmarkIP)
+		c.Location(benchmarkIP)
+	}
+}
+
+func BenchmarkLookup(b *testing.B) {
+	c := benchmarkClient(b)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		c.Lookup(benchmarkIP)
+	}
+}
+
+func TestLookupError(t *testing.T) {
+	err := LookupError{"isp": errors.New("invalid record"), "city": errors.New("corrupt data")}
+	if want := "lookup failed: city: corrupt data; isp: invalid record"; err.Error() != want {
+		t.Errorf("Expected %q, got %q", want, err.Error())
+	}
+}
@@ -0,0 +1,94 @@
+package database
+
+import (
+	"io"
+	"net"
+	"sync"
+)
+
+// Reloadable is a client that can replace its underlying client, e.g. when database files have been updated, while
+// serving lookups concurrently.
+type Reloadable struct {
+	mu     sync.RWMutex
+	client Client
+	open   func() (Client, error)
+}
+
+func NewReloadable(open func() (Client, error)) (*Reloadable, error) {
+	client, err := open()
+	if err != nil {
+		return nil, err
+	}
+	return &Reloadable{client: client, open: open}, nil
+}
+
+// Reload opens a new client and replaces the current one. The current client is kept if opening fails.
+func (r *Reloadable) Reload() error {
+	client, err := r.open()
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	old := r.client
+	r.client = client
+	r.mu.Unlock()
+	// No lookups can be using the old client at this point as they hold the read lock while in progress
+	if c, ok := old.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+func (r *Reloadable) Country(ip net.IP) (Country, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.Country(ip)
+}
+
+func (r *Reloadable) City(ip net.IP) (string, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.City(ip)
+}
+
+func (r *Reloadable) ISP(ip net.IP) (ISP, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.ISP(ip)
+}
+
+func (r *Reloadable) Location(ip net.IP) (Location, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.Location(ip)
+}
+
+func (r *Reloadable) Confidence(ip net.IP) (Confidence, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.Confidence(ip)
+}
+
+func (r *Reloadable) Lookup(ip net.IP) (Record, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.Lookup(ip)
+}
+
+func (r *Reloadable) Raw(ip net.IP) (map[string]interface{}, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.Raw(ip)
+}
+
+func (r *Reloadable) Types() map[string]string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.Types()
+}
+
+func (r *Reloadable) IsEmpty() bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.client.IsEmpty()
+}
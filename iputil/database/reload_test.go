@@ -0,0 +1,96 @@
+package database
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+)
+
+type testClient struct {
+	mu     sync.Mutex
+	name   string
+	closed bool
+}
+
+func (c *testClient) Country(net.IP) (Country, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return Country{}, errors.New("lookup in closed client")
+	}
+	return Country{Name: c.name}, nil
+}
+
+func (c *testClient) City(net.IP) (string, error)                { return c.name, nil }
+func (c *testClient) ISP(net.IP) (ISP, error)                    { return ISP{}, nil }
+func (c *testClient) Location(net.IP) (Location, error)          { return Location{}, nil }
+func (c *testClient) Confidence(net.IP) (Confidence, error)      { return Confidence{}, nil }
+func (c *testClient) Lookup(net.IP) (Record, error)              { return Record{City: c.name}, nil }
+func (c *testClient) Raw(net.IP) (map[string]interface{}, error) { return nil, nil }
+func (c *testClient) Types() map[string]string                   { return nil }
+func (c *testClient) IsEmpty() bool                              { return false }
+
+func (c *testClient) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	var clients []*testClient
+	fail := false
+	r, err := NewReloadable(func() (Client, error) {
+		if fail {
+			return nil, errors.New("open failed")
+		}
+		c := &testClient{name: "Elbonia"}
+		clients = append(clients, c)
+		return c, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				if _, err := r.Country(net.IPv4(127, 0, 0, 1)); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if err := r.Reload(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	for i, c := range clients {
+		if want := i < len(clients)-1; c.closed != want {
+			t.Errorf("Expected closed=%t for client %d, got %t", want, i, c.closed)
+		}
+	}
+
+	fail = true
+	if err := r.Reload(); err == nil {
+		t.Error("Expected error when reload fails")
+	}
+	if country, err := r.Country(net.IPv4(127, 0, 0, 1)); err != nil || country.Name != "Elbonia" {
+		t.Errorf("Expected previous client to be kept, got %q (%v)", country.Name, err)
+	}
+}
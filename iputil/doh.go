@@ -0,0 +1,207 @@
+package iputil
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	dnsTypeA    = 1
+	dnsTypePTR  = 12
+	dnsTypeAAAA = 28
+
+	dnsRcodeServFail = 2
+	dnsRcodeNXDomain = 3
+
+	dnsMessageMediaType = "application/dns-message"
+)
+
+var errInvalidMessage = errors.New("invalid DNS message")
+
+// DoHResolver resolves names using DNS over HTTPS (RFC 8484).
+type DoHResolver struct {
+	URL    string
+	Client *http.Client
+}
+
+type dnsAnswer struct {
+	Type uint16
+	Data []byte
+	Name string
+}
+
+func NewDoHResolver(url string) *DoHResolver {
+	return &DoHResolver{URL: url, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (d *DoHResolver) LookupAddr(ctx context.Context, ip net.IP) (string, error) {
+	answers, err := d.query(ctx, ReverseName(ip), dnsTypePTR)
+	if err != nil {
+		return "", err
+	}
+	for _, a := range answers {
+		if a.Type == dnsTypePTR {
+			return strings.TrimRight(a.Name, "."), nil
+		}
+	}
+	return "", nil
+}
+
+// LookupHost returns the IPv4 and IPv6 addresses of host.
+func (d *DoHResolver) LookupHost(host string) ([]net.IP, error) {
+	var ips []net.IP
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		answers, err := d.query(context.Background(), host, qtype)
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range answers {
+			if (a.Type == dnsTypeA && len(a.Data) == net.IPv4len) || (a.Type == dnsTypeAAAA && len(a.Data) == net.IPv6len) {
+				ips = append(ips, net.IP(append([]byte(nil), a.Data...)))
+			}
+		}
+	}
+	if len(ips) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, Server: d.URL, IsNotFound: true}
+	}
+	return ips, nil
+}
+
+func (d *DoHResolver) query(ctx context.Context, name string, qtype uint16) ([]dnsAnswer, error) {
+	q, err := newQuery(name, qtype)
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", d.URL, bytes.NewReader(q))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", dnsMessageMediaType)
+	req.Header.Set("Accept", dnsMessageMediaType)
+	res, err := d.Client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, &net.DNSError{Err: fmt.Sprintf("unexpected status %d", res.StatusCode), Name: name,
+			Server: d.URL, IsTemporary: res.StatusCode >= 500}
+	}
+	msg, err := ioutil.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	answers, rcode, err := parseResponse(msg)
+	if err != nil {
+		return nil, err
+	}
+	switch rcode {
+	case 0:
+		return answers, nil
+	case dnsRcodeNXDomain:
+		return nil, &net.DNSError{Err: "no such host", Name: name, Server: d.URL, IsNotFound: true}
+	default:
+		return nil, &net.DNSError{Err: fmt.Sprintf("server failure (rcode %d)", rcode), Name: name,
+			Server: d.URL, IsTemporary: rcode == dnsRcodeServFail}
+	}
+}
+
+func newQuery(name string, qtype uint16) ([]byte, error) {
+	// ID is zero, as recommended for DoH, with the recursion desired flag set
+	msg := []byte{0, 0, 1, 0, 0, 1, 0, 0, 0, 0, 0, 0}
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, fmt.Errorf("invalid name: %q", name)
+		}
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	msg = append(msg, 0)
+	msg = append(msg, byte(qtype>>8), byte(qtype), 0, 1)
+	return msg, nil
+}
+
+func parseResponse(msg []byte) ([]dnsAnswer, int, error) {
+	if len(msg) < 12 {
+		return nil, 0, errInvalidMessage
+	}
+	rcode := int(msg[3] & 0x0f)
+	qdcount := binary.BigEndian.Uint16(msg[4:])
+	ancount := binary.BigEndian.Uint16(msg[6:])
+	off := 12
+	for i := 0; i < int(qdcount); i++ {
+		_, n, err := readName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off = n + 4
+	}
+	var answers []dnsAnswer
+	for i := 0; i < int(ancount); i++ {
+		_, n, err := readName(msg, off)
+		if err != nil {
+			return nil, 0, err
+		}
+		off = n
+		if off+10 > len(msg) {
+			return nil, 0, errInvalidMessage
+		}
+		a := dnsAnswer{Type: binary.BigEndian.Uint16(msg[off:])}
+		rdlength := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlength > len(msg) {
+			return nil, 0, errInvalidMessage
+		}
+		a.Data = msg[off : off+rdlength]
+		if a.Type == dnsTypePTR {
+			if a.Name, _, err = readName(msg, off); err != nil {
+				return nil, 0, err
+			}
+		}
+		answers = append(answers, a)
+		off += rdlength
+	}
+	return answers, rcode, nil
+}
+
+// readName reads a possibly compressed name at offset off and returns the name and the offset following it.
+func readName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for hops := 0; hops < 64; hops++ {
+		if off >= len(msg) {
+			return "", 0, errInvalidMessage
+		}
+		n := int(msg[off])
+		switch {
+		case n == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case n&0xc0 == 0xc0:
+			if off+1 >= len(msg) {
+				return "", 0, errInvalidMessage
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+		default:
+			if off+1+n > len(msg) {
+				return "", 0, errInvalidMessage
+			}
+			labels = append(labels, string(msg[off+1:off+1+n]))
+			off += 1 + n
+		}
+	}
+	return "", 0, errInvalidMessage
+}
@@ -1,6 +1,7 @@
 package iputil
 
 import (
+	"context"
 	"fmt"
 	"math/big"
 	"net"
@@ -8,8 +9,8 @@ import (
 	"time"
 )
 
-func LookupAddr(ip net.IP) (string, error) {
-	names, err := net.LookupAddr(ip.String())
+func LookupAddr(ctx context.Context, ip net.IP) (string, error) {
+	names, err := net.DefaultResolver.LookupAddr(ctx, ip.String())
 	if err != nil || len(names) == 0 {
 		return "", err
 	}
@@ -17,6 +18,46 @@ func LookupAddr(ip net.IP) (string, error) {
 	return strings.TrimRight(names[0], "."), nil
 }
 
+func LookupHost(host string) ([]net.IP, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, 0, len(addrs))
+	for _, a := range addrs {
+		ips = append(ips, a.IP)
+	}
+	return ips, nil
+}
+
+// RetryLookupAddr wraps lookup to retry temporary failures, such as SERVFAIL, up to retries times. The wait between
+// attempts starts at backoff and is doubled for each attempt. Names that do not exist are not retried, and retrying
+// stops when ctx is done.
+func RetryLookupAddr(lookup func(context.Context, net.IP) (string, error), retries int,
+	backoff time.Duration) func(context.Context, net.IP) (string, error) {
+	return func(ctx context.Context, ip net.IP) (string, error) {
+		name, err := lookup(ctx, ip)
+		for i := 0; i < retries && retryable(err); i++ {
+			timer := time.NewTimer(backoff << uint(i))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return name, err
+			case <-timer.C:
+			}
+			name, err = lookup(ctx, ip)
+		}
+		return name, err
+	}
+}
+
+func retryable(err error) bool {
+	dnsErr, ok := err.(*net.DNSError)
+	return ok && !dnsErr.IsNotFound && (dnsErr.IsTemporary || dnsErr.IsTimeout)
+}
+
 func LookupPort(ip net.IP, port uint64) error {
 	address := fmt.Sprintf("[%s]:%d", ip, port)
 	conn, err := net.DialTimeout("tcp", address, 2*time.Second)
@@ -36,3 +77,81 @@ func ToDecimal(ip net.IP) uint64 {
 	}
 	return i.Uint64()
 }
+
+// FromDecimal parses the integer representation of an IP address, as returned by ToDecimal. The integer is decimal, or
+// hexadecimal or octal if prefixed with 0x or 0o. Values fitting in 32 bits are IPv4 addresses, larger values up to 128
+// bits IPv6 addresses. Decimal values with leading zeroes are rejected, as they are commonly read as octal.
+func FromDecimal(s string) (net.IP, error) {
+	digits, base := s, 10
+	switch {
+	case strings.HasPrefix(s, "0x"), strings.HasPrefix(s, "0X"):
+		digits, base = s[2:], 16
+	case strings.HasPrefix(s, "0o"), strings.HasPrefix(s, "0O"):
+		digits, base = s[2:], 8
+	case len(s) > 1 && s[0] == '0':
+		return nil, fmt.Errorf("ambiguous number: %s: use 0o prefix for octal", s)
+	}
+	i, ok := new(big.Int).SetString(digits, base)
+	// SetString accepts a sign, which is not valid here
+	if !ok || digits == "" || digits[0] == '+' || digits[0] == '-' {
+		return nil, fmt.Errorf("invalid number: %s", s)
+	}
+	switch n := i.BitLen(); {
+	case n <= 32:
+		b := make([]byte, 4)
+		return net.IP(i.FillBytes(b)).To16(), nil
+	case n <= 128:
+		b := make([]byte, 16)
+		return net.IP(i.FillBytes(b)), nil
+	}
+	return nil, fmt.Errorf("number too large: %s", s)
+}
+
+func Anonymize(ip net.IP) net.IP {
+	if ip.To4() != nil {
+		return ip.Mask(net.CIDRMask(24, 32))
+	}
+	return ip.Mask(net.CIDRMask(48, 128))
+}
+
+func ReverseName(ip net.IP) string {
+	if to4 := ip.To4(); to4 != nil {
+		return fmt.Sprintf("%d.%d.%d.%d.in-addr.arpa", to4[3], to4[2], to4[1], to4[0])
+	}
+	const hexDigits = "0123456789abcdef"
+	ip = ip.To16()
+	var b strings.Builder
+	for i := len(ip) - 1; i >= 0; i-- {
+		b.WriteByte(hexDigits[ip[i]&0x0f])
+		b.WriteByte('.')
+		b.WriteByte(hexDigits[ip[i]>>4])
+		b.WriteByte('.')
+	}
+	b.WriteString("ip6.arpa")
+	return b.String()
+}
+
+func ParseNetworks(values []string) ([]*net.IPNet, error) {
+	var networks []*net.IPNet
+	for _, v := range values {
+		if !strings.Contains(v, "/") {
+			ip := net.ParseIP(v)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid IP: %s", v)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				ip = ip.To4()
+				bits = 32
+			}
+			networks = append(networks, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, n, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, err
+		}
+		networks = append(networks, n)
+	}
+	return networks, nil
+}
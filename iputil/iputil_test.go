@@ -1,8 +1,14 @@
 package iputil
 
 import (
+	"context"
+	"errors"
+	"io/ioutil"
 	"net"
+	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
 )
 
 func TestToDecimal(t *testing.T) {
@@ -20,3 +26,247 @@ func TestToDecimal(t *testing.T) {
 		}
 	}
 }
+
+func TestAnonymize(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{"127.0.0.1", "127.0.0.0"},
+		{"192.0.2.255", "192.0.2.0"},
+		{"2001:db8:1234:5678:9abc:def0:1234:5678", "2001:db8:1234::"},
+		{"::1", "::"},
+	}
+	for _, tt := range tests {
+		ip := Anonymize(net.ParseIP(tt.in))
+		if got := ip.String(); got != tt.out {
+			t.Errorf("Expected %s, got %s for IP %s", tt.out, got, tt.in)
+		}
+	}
+}
+
+func TestParseNetworks(t *testing.T) {
+	networks, err := ParseNetworks([]string{"192.0.2.0/24", "2001:db8::/32", "198.51.100.1", "::1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in  string
+		out bool
+	}{
+		{"192.0.2.42", true},
+		{"2001:db8::1", true},
+		{"198.51.100.1", true},
+		{"198.51.100.2", false},
+		{"::1", true},
+		{"::2", false},
+	}
+	for _, tt := range tests {
+		contains := false
+		for _, n := range networks {
+			if n.Contains(net.ParseIP(tt.in)) {
+				contains = true
+			}
+		}
+		if contains != tt.out {
+			t.Errorf("Expected %t, got %t for IP %s", tt.out, contains, tt.in)
+		}
+	}
+	if _, err := ParseNetworks([]string{"foo"}); err == nil {
+		t.Error("Expected error for invalid network")
+	}
+}
+
+func TestFromDecimal(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+		err bool
+	}{
+		{"0", "0.0.0.0", false},
+		{"2130706433", "127.0.0.1", false},
+		{"0x7f000001", "127.0.0.1", false},
+		{"0X7F000001", "127.0.0.1", false},
+		{"0o17700000001", "127.0.0.1", false},
+		{"4294967295", "255.255.255.255", false},
+		{"4294967296", "::1:0:0", false},
+		{"42540766411282592856903984951653826601", "2001:db8::29", false},
+		{"0x20010db8000000000000000000000029", "2001:db8::29", false},
+		{"017700000001", "", true},
+		{"0x", "", true},
+		{"-1", "", true},
+		{"0x-1", "", true},
+		{"+1", "", true},
+		{"1_000", "", true},
+		{"0xfoo", "", true},
+		{"0o8", "", true},
+		{"340282366920938463463374607431768211456", "", true},
+	}
+	for _, tt := range tests {
+		ip, err := FromDecimal(tt.in)
+		if (err != nil) != tt.err {
+			t.Errorf("Expected error=%t for %s, got %v", tt.err, tt.in, err)
+			continue
+		}
+		if err == nil && ip.String() != tt.out {
+			t.Errorf("Expected %s, got %s for %s", tt.out, ip, tt.in)
+		}
+	}
+}
+
+func TestReverseName(t *testing.T) {
+	var tests = []struct {
+		in  string
+		out string
+	}{
+		{"192.0.2.1", "1.2.0.192.in-addr.arpa"},
+		{"2001:db8::567:89ab", "b.a.9.8.7.6.5.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.0.8.b.d.0.1.0.0.2.ip6.arpa"},
+	}
+	for _, tt := range tests {
+		if got := ReverseName(net.ParseIP(tt.in)); got != tt.out {
+			t.Errorf("Expected %s, got %s for IP %s", tt.out, got, tt.in)
+		}
+	}
+}
+
+func TestRetryLookupAddr(t *testing.T) {
+	var tests = []struct {
+		err      error
+		attempts int
+	}{
+		{nil, 1},
+		{&net.DNSError{IsNotFound: true}, 1},
+		{&net.DNSError{IsTemporary: true}, 3},
+		{&net.DNSError{IsTimeout: true}, 3},
+		{errors.New("other"), 1},
+	}
+	for _, tt := range tests {
+		attempts := 0
+		lookup := RetryLookupAddr(func(context.Context, net.IP) (string, error) {
+			attempts++
+			return "", tt.err
+		}, 2, 0)
+		lookup(context.Background(), net.ParseIP("127.0.0.1"))
+		if attempts != tt.attempts {
+			t.Errorf("Expected %d attempts for %v, got %d", tt.attempts, tt.err, attempts)
+		}
+	}
+
+	attempts := 0
+	lookup := RetryLookupAddr(func(context.Context, net.IP) (string, error) {
+		attempts++
+		if attempts < 2 {
+			return "", &net.DNSError{IsTemporary: true}
+		}
+		return "localhost", nil
+	}, 2, 0)
+	if name, err := lookup(context.Background(), net.ParseIP("127.0.0.1")); err != nil || name != "localhost" {
+		t.Errorf("Expected localhost, got %q (%v)", name, err)
+	}
+
+	// Deadline passes while waiting to retry
+	attempts = 0
+	lookup = RetryLookupAddr(func(context.Context, net.IP) (string, error) {
+		attempts++
+		return "", &net.DNSError{IsTemporary: true}
+	}, 5, time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if _, err := lookup(ctx, net.ParseIP("127.0.0.1")); err == nil {
+		t.Error("Expected error when deadline passes")
+	}
+	if attempts != 1 {
+		t.Errorf("Expected 1 attempt before deadline, got %d", attempts)
+	}
+	if elapsed := time.Since(start); elapsed > 500*time.Millisecond {
+		t.Errorf("Expected retries to stop at deadline, took %s", elapsed)
+	}
+}
+
+func TestDoHLookupAddr(t *testing.T) {
+	rcode := byte(0)
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if got := r.Header.Get("Content-Type"); got != dnsMessageMediaType {
+			t.Errorf("Expected Content-Type %s, got %s", dnsMessageMediaType, got)
+		}
+		msg, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Turn the query into a response by setting flags and appending a PTR answer pointing to the question
+		msg[2], msg[3] = 0x81, 0x80|rcode
+		if rcode == 0 {
+			msg[7] = 1
+			msg = append(msg, 0xc0, 12, 0, dnsTypePTR, 0, 1, 0, 0, 0, 60, 0, 11)
+			msg = append(msg, 9, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't', 0)
+		}
+		w.Header().Set("Content-Type", dnsMessageMediaType)
+		w.Write(msg)
+	}))
+	defer s.Close()
+
+	r := NewDoHResolver(s.URL)
+	name, err := r.LookupAddr(context.Background(), net.ParseIP("127.0.0.1"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if name != "localhost" {
+		t.Errorf("Expected %s, got %s", "localhost", name)
+	}
+
+	var tests = []struct {
+		rcode     byte
+		notFound  bool
+		temporary bool
+	}{
+		{dnsRcodeNXDomain, true, false},
+		{dnsRcodeServFail, false, true},
+	}
+	for _, tt := range tests {
+		rcode = tt.rcode
+		_, err := r.LookupAddr(context.Background(), net.ParseIP("127.0.0.1"))
+		dnsErr, ok := err.(*net.DNSError)
+		if !ok {
+			t.Fatalf("Expected *net.DNSError for rcode %d, got %v", tt.rcode, err)
+		}
+		if dnsErr.IsNotFound != tt.notFound || dnsErr.IsTemporary != tt.temporary {
+			t.Errorf("Expected IsNotFound=%t IsTemporary=%t for rcode %d, got %t and %t", tt.notFound, tt.temporary,
+				tt.rcode, dnsErr.IsNotFound, dnsErr.IsTemporary)
+		}
+	}
+}
+
+func TestDoHLookupHost(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		msg, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		qtype := msg[len(msg)-3]
+		msg[2], msg[3], msg[7] = 0x81, 0x80, 1
+		msg = append(msg, 0xc0, 12, 0, qtype, 0, 1, 0, 0, 0, 60)
+		if qtype == dnsTypeA {
+			msg = append(msg, 0, 4, 192, 0, 2, 1)
+		} else {
+			msg = append(msg, 0, 16, 0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 1)
+		}
+		w.Header().Set("Content-Type", dnsMessageMediaType)
+		w.Write(msg)
+	}))
+	defer s.Close()
+
+	ips, err := NewDoHResolver(s.URL).LookupHost("example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []net.IP{net.ParseIP("192.0.2.1").To4(), net.ParseIP("2001:db8::1")}
+	if len(ips) != len(want) {
+		t.Fatalf("Expected %v, got %v", want, ips)
+	}
+	for i := range want {
+		if !ips[i].Equal(want[i]) {
+			t.Errorf("Expected %s, got %s", want[i], ips[i])
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package tor
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+type ExitList struct {
+	URL    string
+	client *http.Client
+	mu     sync.RWMutex
+	ips    map[string]bool
+}
+
+func New(url string) *ExitList {
+	return &ExitList{
+		URL:    url,
+		client: &http.Client{Timeout: 30 * time.Second},
+		ips:    make(map[string]bool),
+	}
+}
+
+func (l *ExitList) Contains(ip net.IP) bool {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.ips[ip.String()]
+}
+
+func (l *ExitList) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.ips)
+}
+
+func (l *ExitList) Refresh() error {
+	res, err := l.client.Get(l.URL)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: unexpected status %d", l.URL, res.StatusCode)
+	}
+	ips, err := parse(res.Body)
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	l.ips = ips
+	l.mu.Unlock()
+	return nil
+}
+
+func (l *ExitList) Watch(interval time.Duration, onError func(error)) {
+	for {
+		if err := l.Refresh(); err != nil && onError != nil {
+			onError(err)
+		}
+		time.Sleep(interval)
+	}
+}
+
+func parse(r io.Reader) (map[string]bool, error) {
+	ips := make(map[string]bool)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ip := net.ParseIP(line)
+		if ip == nil {
+			return nil, fmt.Errorf("invalid IP in exit list: %q", line)
+		}
+		ips[ip.String()] = true
+	}
+	return ips, scanner.Err()
+}
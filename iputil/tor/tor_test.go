@@ -0,0 +1,43 @@
+package tor
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRefresh(t *testing.T) {
+	body := "# comment\n192.0.2.1\n\n2001:db8::1\n"
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, body)
+	}))
+	defer s.Close()
+
+	l := New(s.URL)
+	if err := l.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	var tests = []struct {
+		in  string
+		out bool
+	}{
+		{"192.0.2.1", true},
+		{"2001:db8:0::1", true},
+		{"192.0.2.2", false},
+	}
+	for _, tt := range tests {
+		if got := l.Contains(net.ParseIP(tt.in)); got != tt.out {
+			t.Errorf("Expected %t, got %t for IP %s", tt.out, got, tt.in)
+		}
+	}
+
+	body = "foo\n"
+	if err := l.Refresh(); err == nil {
+		t.Error("Expected error for invalid exit list")
+	}
+	if got := l.Len(); got != 2 {
+		t.Errorf("Expected failed refresh to keep %d IPs, got %d", 2, got)
+	}
+}
@@ -0,0 +1,232 @@
+package ja3
+
+import (
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	recordTypeHandshake      = 22
+	handshakeTypeClientHello = 1
+	extensionSupportedGroups = 10
+	extensionPointFormats    = 11
+
+	// maxHelloSize bounds how much of a connection is buffered while waiting for a complete ClientHello
+	maxHelloSize = 1 << 16
+)
+
+var errInvalidHello = errors.New("invalid TLS ClientHello")
+
+// Listener records the TLS ClientHello sent on accepted connections, so that the JA3 fingerprint of the client can be
+// computed. It must be wrapped by the TLS listener, as it inspects the raw bytes of the connection.
+type Listener struct {
+	net.Listener
+}
+
+// Conn is a connection accepted by Listener.
+type Conn struct {
+	net.Conn
+	mu          sync.Mutex
+	buf         []byte
+	done        bool
+	fingerprint string
+}
+
+func (l *Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return &Conn{Conn: c}, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.done || n == 0 {
+		return n, err
+	}
+	c.buf = append(c.buf, b[:n]...)
+	hello, herr := readClientHello(c.buf)
+	if hello == nil && herr == nil && len(c.buf) < maxHelloSize {
+		return n, err // Incomplete
+	}
+	if herr == nil && hello != nil {
+		if s, perr := String(hello); perr == nil {
+			sum := md5.Sum([]byte(s))
+			c.fingerprint = hex.EncodeToString(sum[:])
+		}
+	}
+	c.done = true
+	c.buf = nil
+	return n, err
+}
+
+// Fingerprint returns the JA3 hash of the ClientHello received on c, or an empty string if none has been received.
+func (c *Conn) Fingerprint() string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.fingerprint
+}
+
+// Fingerprint returns the JA3 hash of the client connected on c, which must be a connection accepted by Listener, or a
+// TLS connection wrapping one.
+func Fingerprint(c net.Conn) string {
+	if tc, ok := c.(*tls.Conn); ok {
+		c = tc.NetConn()
+	}
+	if jc, ok := c.(*Conn); ok {
+		return jc.Fingerprint()
+	}
+	return ""
+}
+
+// readClientHello returns the ClientHello handshake message at the start of b, reassembling it from multiple records
+// if necessary. Both return values are nil if b does not yet contain the complete message.
+func readClientHello(b []byte) ([]byte, error) {
+	var msg []byte
+	for len(b) >= 5 {
+		if b[0] != recordTypeHandshake {
+			return nil, errInvalidHello
+		}
+		n := int(binary.BigEndian.Uint16(b[3:5]))
+		if len(b) < 5+n {
+			return nil, nil
+		}
+		msg = append(msg, b[5:5+n]...)
+		b = b[5+n:]
+		if len(msg) >= 4 {
+			if msg[0] != handshakeTypeClientHello {
+				return nil, errInvalidHello
+			}
+			if size := 4 + (int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3])); len(msg) >= size {
+				return msg[:size], nil
+			}
+		}
+	}
+	return nil, nil
+}
+
+// String returns the JA3 string of a ClientHello handshake message, i.e. the comma-separated version, cipher suites,
+// extensions, supported groups and point formats. GREASE values (RFC 8701) are ignored.
+func String(hello []byte) (string, error) {
+	r := reader(hello)
+	if typ, ok := r.uint8(); !ok || typ != handshakeTypeClientHello {
+		return "", errInvalidHello
+	}
+	r.skip(3) // Length
+	version, _ := r.uint16()
+	r.skip(32) // Random
+	sessionID, _ := r.uint8()
+	r.skip(int(sessionID))
+	ciphers, ok := r.vector16()
+	if !ok {
+		return "", errInvalidHello
+	}
+	compression, _ := r.uint8()
+	if !r.skip(int(compression)) {
+		return "", errInvalidHello
+	}
+	var extensions, groups, pointFormats []uint16
+	if exts, ok := r.vector16(); ok {
+		for len(exts) > 0 {
+			typ, _ := exts.uint16()
+			data, ok := exts.vector16()
+			if !ok {
+				return "", errInvalidHello
+			}
+			if isGREASE(typ) {
+				continue
+			}
+			extensions = append(extensions, typ)
+			switch typ {
+			case extensionSupportedGroups:
+				list, _ := data.vector16()
+				groups = list.uint16s()
+			case extensionPointFormats:
+				n, _ := data.uint8()
+				for i := 0; i < int(n) && len(data) > 0; i++ {
+					f, _ := data.uint8()
+					pointFormats = append(pointFormats, uint16(f))
+				}
+			}
+		}
+	}
+	return strings.Join([]string{
+		strconv.Itoa(int(version)),
+		join(ciphers.uint16s()),
+		join(extensions),
+		join(groups),
+		join(pointFormats),
+	}, ","), nil
+}
+
+func isGREASE(v uint16) bool { return v&0x0f0f == 0x0a0a && v>>8 == v&0xff }
+
+func join(values []uint16) string {
+	var s []string
+	for _, v := range values {
+		if !isGREASE(v) {
+			s = append(s, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(s, "-")
+}
+
+type reader []byte
+
+func (r *reader) skip(n int) bool {
+	if len(*r) < n {
+		*r = nil
+		return false
+	}
+	*r = (*r)[n:]
+	return true
+}
+
+func (r *reader) uint8() (uint8, bool) {
+	if len(*r) < 1 {
+		return 0, false
+	}
+	v := (*r)[0]
+	*r = (*r)[1:]
+	return v, true
+}
+
+func (r *reader) uint16() (uint16, bool) {
+	if len(*r) < 2 {
+		return 0, false
+	}
+	v := binary.BigEndian.Uint16(*r)
+	*r = (*r)[2:]
+	return v, true
+}
+
+// vector16 reads a vector with a 16-bit length prefix.
+func (r *reader) vector16() (reader, bool) {
+	n, ok := r.uint16()
+	if !ok || len(*r) < int(n) {
+		*r = nil
+		return nil, false
+	}
+	v := (*r)[:n]
+	*r = (*r)[n:]
+	return v, true
+}
+
+func (r reader) uint16s() []uint16 {
+	var values []uint16
+	for len(r) >= 2 {
+		v, _ := r.uint16()
+		values = append(values, v)
+	}
+	return values
+}
@@ -0,0 +1,116 @@
+package ja3
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+)
+
+func clientHello(version uint16, ciphers, extensions []uint16, groups []uint16, pointFormats []byte) []byte {
+	u16 := func(v uint16) []byte { return []byte{byte(v >> 8), byte(v)} }
+	var exts []byte
+	for _, e := range extensions {
+		var data []byte
+		switch e {
+		case extensionSupportedGroups:
+			data = u16(uint16(2 * len(groups)))
+			for _, g := range groups {
+				data = append(data, u16(g)...)
+			}
+		case extensionPointFormats:
+			data = append([]byte{byte(len(pointFormats))}, pointFormats...)
+		}
+		exts = append(exts, u16(e)...)
+		exts = append(exts, u16(uint16(len(data)))...)
+		exts = append(exts, data...)
+	}
+	body := u16(version)
+	body = append(body, make([]byte, 32)...) // Random
+	body = append(body, 0)                   // Session ID
+	body = append(body, u16(uint16(2*len(ciphers)))...)
+	for _, c := range ciphers {
+		body = append(body, u16(c)...)
+	}
+	body = append(body, 1, 0) // Compression
+	body = append(body, u16(uint16(len(exts)))...)
+	body = append(body, exts...)
+	return append([]byte{handshakeTypeClientHello, 0, byte(len(body) >> 8), byte(len(body))}, body...)
+}
+
+func record(msg []byte) []byte {
+	return append([]byte{recordTypeHandshake, 3, 1, byte(len(msg) >> 8), byte(len(msg))}, msg...)
+}
+
+func TestString(t *testing.T) {
+	var tests = []struct {
+		hello []byte
+		out   string
+	}{
+		{clientHello(771, []uint16{0x1301, 0xc02b}, nil, nil, nil), "771,4865-49195,,,"},
+		{clientHello(771, []uint16{0x0a0a, 0x1301, 0xc02b}, []uint16{0x1a1a, 0, 10, 11, 0xfafa, 16},
+			[]uint16{0x2a2a, 29, 23}, []byte{0}), "771,4865-49195,0-10-11-16,29-23,0"},
+	}
+	for _, tt := range tests {
+		got, err := String(tt.hello)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got != tt.out {
+			t.Errorf("Expected %q, got %q", tt.out, got)
+		}
+	}
+	if _, err := String([]byte{handshakeTypeClientHello, 0, 0, 10, 3, 3}); err == nil {
+		t.Error("Expected error for truncated ClientHello")
+	}
+}
+
+func TestReadClientHello(t *testing.T) {
+	hello := clientHello(771, []uint16{0x1301}, nil, nil, nil)
+	split := append(record(hello[:10]), record(hello[10:])...)
+	var tests = []struct {
+		in       []byte
+		complete bool
+		err      bool
+	}{
+		{record(hello), true, false},
+		{record(hello)[:20], false, false},
+		{split, true, false},
+		{split[:20], false, false},
+		{[]byte("GET / HTTP/1.1\r\n"), false, true},
+	}
+	for i, tt := range tests {
+		msg, err := readClientHello(tt.in)
+		if complete := msg != nil; complete != tt.complete {
+			t.Errorf("#%d: Expected complete=%t, got %t", i, tt.complete, complete)
+		}
+		if tt.complete && string(msg) != string(hello) {
+			t.Errorf("#%d: Expected %x, got %x", i, hello, msg)
+		}
+		if (err != nil) != tt.err {
+			t.Errorf("#%d: Expected error=%t, got %v", i, tt.err, err)
+		}
+	}
+}
+
+func TestFingerprint(t *testing.T) {
+	client, server := net.Pipe()
+	c := &Conn{Conn: server}
+	go func() {
+		tls.Client(client, &tls.Config{InsecureSkipVerify: true}).Handshake()
+	}()
+	// Read until the complete ClientHello has been seen, without responding
+	b := make([]byte, 512)
+	for c.Fingerprint() == "" {
+		if _, err := c.Read(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	client.Close()
+	if got := Fingerprint(c); len(got) != 32 || strings.Trim(got, "0123456789abcdef") != "" {
+		t.Errorf("Expected MD5 hex digest, got %q", got)
+	}
+	if got := Fingerprint(client); got != "" {
+		t.Errorf("Expected no fingerprint for plain connection, got %q", got)
+	}
+}
@@ -0,0 +1,95 @@
+package proxyproto
+
+import (
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+func TestListener(t *testing.T) {
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	_, other, _ := net.ParseCIDR("192.0.2.0/24")
+	v2 := append([]byte{}, v2Signature...)
+	v2 = append(v2, 0x21, 0x11, 0, 12, 192, 0, 2, 1, 192, 0, 2, 2, 0x05, 0x39, 0, 80)
+	v2Local := append([]byte{}, v2Signature...)
+	v2Local = append(v2Local, 0x20, 0, 0, 0)
+
+	var tests = []struct {
+		trusted *net.IPNet
+		in      string
+		addr    string
+		out     string
+	}{
+		{loopback, "PROXY TCP4 192.0.2.1 192.0.2.2 1337 80\r\nGET /", "192.0.2.1:1337", "GET /"},
+		{loopback, "PROXY TCP6 2001:db8::1 2001:db8::2 1337 80\r\nGET /", "[2001:db8::1]:1337", "GET /"},
+		{loopback, "PROXY UNKNOWN\r\nGET /", "127.0.0.1", "GET /"},
+		{loopback, string(v2) + "GET /", "192.0.2.1:1337", "GET /"},
+		{loopback, string(v2Local) + "GET /", "127.0.0.1", "GET /"},
+		{loopback, "GET /", "127.0.0.1", "GET /"},
+		{loopback, "POST /", "127.0.0.1", "POST /"},
+		{other, "PROXY TCP4 192.0.2.1 192.0.2.2 1337 80\r\nGET /", "127.0.0.1", "PROXY TCP4 192.0.2.1 192.0.2.2 1337 80\r\nGET /"},
+	}
+	for _, tt := range tests {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		l := &Listener{Listener: ln, Trusted: []*net.IPNet{tt.trusted}}
+		go func() {
+			c, err := net.Dial("tcp", ln.Addr().String())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			c.Write([]byte(tt.in))
+			c.Close()
+		}()
+		c, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		addr := c.RemoteAddr().String()
+		if host, _, _ := net.SplitHostPort(addr); host == "127.0.0.1" {
+			addr = host // Ephemeral port
+		}
+		if addr != tt.addr {
+			t.Errorf("Expected remote address %s for %q, got %s", tt.addr, tt.in, addr)
+		}
+		b, err := ioutil.ReadAll(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(b) != tt.out {
+			t.Errorf("Expected %q for %q, got %q", tt.out, tt.in, b)
+		}
+		c.Close()
+		ln.Close()
+	}
+}
+
+func TestInvalidHeader(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	_, loopback, _ := net.ParseCIDR("127.0.0.0/8")
+	l := &Listener{Listener: ln, Trusted: []*net.IPNet{loopback}}
+	go func() {
+		c, err := net.Dial("tcp", ln.Addr().String())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		c.Write([]byte("PROXY TCP4 foo 192.0.2.2 1337 80\r\nGET /"))
+		c.Close()
+	}()
+	c, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := ioutil.ReadAll(c); err != errInvalidHeader {
+		t.Errorf("Expected %v, got %v", errInvalidHeader, err)
+	}
+}